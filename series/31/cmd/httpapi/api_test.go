@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"learn-go/series/31/problem"
+)
+
+func do(t *testing.T, h http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, path, nil)
+	} else {
+		req = httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+func TestConcurrentEditsConflict(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`)
+
+	get := do(t, h, http.MethodGet, "/orders/1001", "")
+	tag := get.Header().Get("ETag")
+	if tag != `"1"` {
+		t.Fatalf("ETag = %q, want \"1\"", tag)
+	}
+
+	first := do(t, h, http.MethodPatch, "/orders/1001", `{"price":30}`, "If-Match", tag)
+	if first.Code != http.StatusOK || first.Header().Get("ETag") != `"2"` {
+		t.Fatalf("first edit: status=%d etag=%q", first.Code, first.Header().Get("ETag"))
+	}
+	second := do(t, h, http.MethodPut, "/orders/1001", `{"item":"tea","price":12}`, "If-Match", tag)
+	if second.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale edit: status=%d, want 412", second.Code)
+	}
+	if del := do(t, h, http.MethodDelete, "/orders/1001", "", "If-Match", tag); del.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale delete: status=%d, want 412", del.Code)
+	}
+
+	ord := decode[order](t, do(t, h, http.MethodGet, "/orders/1001", ""))
+	if ord.Item != "latte" || ord.Price != 30 || ord.Version != 2 {
+		t.Fatalf("order = %+v, want the first edit only", ord)
+	}
+
+	if del := do(t, h, http.MethodDelete, "/orders/1001", "", "If-Match", `"2"`); del.Code != http.StatusNoContent {
+		t.Fatalf("delete: status=%d, want 204", del.Code)
+	}
+	if got := do(t, h, http.MethodGet, "/orders/1001", ""); got.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: status=%d, want 404", got.Code)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	for i, price := range []int{30, 10, 50, 20, 40, 20} {
+		item := "latte"
+		if i%2 == 1 {
+			item = "tea"
+		}
+		do(t, h, http.MethodPost, "/orders", `{"item":"`+item+`","price":`+strconv.Itoa(price)+`}`)
+	}
+
+	var ids []int
+	path := "/orders?limit=2&sort=-price&min_price=15"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination does not terminate")
+		}
+		page := decode[orderPage](t, do(t, h, http.MethodGet, path, ""))
+		for _, ord := range page.Orders {
+			ids = append(ids, ord.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/orders?limit=2&sort=-price&min_price=15&cursor=" + page.NextCursor
+	}
+	want := []int{1003, 1005, 1001, 1006, 1004}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+
+	page := decode[orderPage](t, do(t, h, http.MethodGet, "/orders?item=tea&max_price=15", ""))
+	if len(page.Orders) != 1 || page.Orders[0].ID != 1002 || page.NextCursor != "" {
+		t.Fatalf("filtered page = %+v", page)
+	}
+
+	for _, bad := range []string{"limit=0", "limit=x", "sort=weight", "min_price=-1", "min_price=9&max_price=2", "created_after=yesterday", "cursor=!!"} {
+		if rec := do(t, h, http.MethodGet, "/orders?"+bad, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, rec.Code)
+		}
+	}
+	first := decode[orderPage](t, do(t, h, http.MethodGet, "/orders?limit=1", ""))
+	if rec := do(t, h, http.MethodGet, "/orders?sort=price&cursor="+first.NextCursor, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("cursor reused with another sort: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`)
+
+	for _, to := range []string{statusPaid, statusShipped, statusDelivered} {
+		rec := do(t, h, http.MethodPost, "/orders/1001/transitions", `{"to":"`+to+`","actor":"ops"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("to %s: status = %d body=%s", to, rec.Code, rec.Body)
+		}
+	}
+
+	rec := do(t, h, http.MethodPost, "/orders/1001/transitions", `{"to":"canceled","actor":"ops"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("cancel delivered: status = %d, want 409", rec.Code)
+	}
+	conflict := decode[struct{ Allowed []string }](t, rec)
+	if fmt.Sprint(conflict.Allowed) != "[refunded]" {
+		t.Fatalf("allowed = %v, want [refunded]", conflict.Allowed)
+	}
+
+	history := decode[[]transition](t, do(t, h, http.MethodGet, "/orders/1001/transitions", ""))
+	if len(history) != 3 || history[0].From != statusCreated || history[2].To != statusDelivered || history[1].Actor != "ops" {
+		t.Fatalf("history = %+v", history)
+	}
+	if rec := do(t, h, http.MethodPost, "/orders/1001/transitions", `{"to":"lost","actor":"ops"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown status: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+
+	rec := do(t, h, http.MethodPost, "/orders", `{"items":[{"name":"","unit_price":0}]}`, "X-Request-Id", "trace-42")
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("Content-Type") != problem.ContentType {
+		t.Fatalf("status = %d content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	p := decode[problem.Problem](t, rec)
+	if p.Code != problem.CodeValidation || p.RequestID != "trace-42" || len(p.Errors) != 2 || p.Errors[1].Field != "items[0].unit_price" {
+		t.Fatalf("problem = %+v", p)
+	}
+
+	rec = do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":"28"}`)
+	if p := decode[problem.Problem](t, rec); p.Code != problem.CodeValidation || p.Errors[0].Field != "price" {
+		t.Fatalf("wrong type: %+v", p)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		code         problem.Code
+	}{
+		{http.MethodGet, "/orders/abc", problem.CodeInvalidID},
+		{http.MethodGet, "/orders/4040", problem.CodeNotFound},
+		{http.MethodGet, "/nowhere", problem.CodeNotFound},
+		{http.MethodDelete, "/orders", problem.CodeMethodNotAllowed},
+		{http.MethodGet, "/orders?limit=0", problem.CodeInvalidQuery},
+	} {
+		rec := do(t, h, tc.method, tc.path, "")
+		p := decode[problem.Problem](t, rec)
+		if p.Code != tc.code || p.Status != rec.Code || p.RequestID == "" || p.RequestID != rec.Header().Get("X-Request-Id") {
+			t.Errorf("%s %s: status = %d problem = %+v, want %s", tc.method, tc.path, rec.Code, p, tc.code)
+		}
+	}
+}
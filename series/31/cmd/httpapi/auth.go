@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"learn-go/series/31/problem"
+)
+
+const defaultAuthSkew = 5 * time.Minute
+
+const (
+	headerKeyID     = "X-Key-Id"
+	headerTimestamp = "X-Timestamp"
+	headerNonce     = "X-Nonce"
+	headerSignature = "X-Signature"
+)
+
+// caller is who made the request. logMiddleware puts an empty one in the
+// context before auth runs so it can log whoever auth fills in.
+type caller struct {
+	Identity string
+	Scheme   string
+}
+
+type callerKey struct{}
+
+func withCaller(ctx context.Context) (context.Context, *caller) {
+	if c, ok := ctx.Value(callerKey{}).(*caller); ok {
+		return ctx, c
+	}
+	c := &caller{}
+	return context.WithValue(ctx, callerKey{}, c), c
+}
+
+// identityFrom returns the authenticated caller, or "" when auth is off.
+func identityFrom(ctx context.Context) string {
+	if c, ok := ctx.Value(callerKey{}).(*caller); ok {
+		return c.Identity
+	}
+	return ""
+}
+
+type hmacKey struct {
+	identity string
+	secret   []byte
+}
+
+// authenticator accepts static API keys and HMAC-SHA256 signed requests.
+// API keys are held by their SHA-256 so a lookup does not compare secrets.
+type authenticator struct {
+	apiKeys  map[[sha256.Size]byte]string
+	hmacKeys map[string]hmacKey
+	skew     time.Duration
+	now      func() time.Time
+	public   map[string]bool
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+}
+
+// loadKeyfile reads credentials, one per line:
+//
+//	apikey <identity> <key>
+//	hmac   <identity> <key-id> <secret>
+//
+// Blank lines and lines starting with # are ignored.
+func loadKeyfile(path string, skew time.Duration) (*authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open keyfile: %w", err)
+	}
+	defer f.Close()
+
+	a := newAuthenticator(skew)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch {
+		case fields[0] == "apikey" && len(fields) == 3:
+			a.apiKeys[sha256.Sum256([]byte(fields[2]))] = fields[1]
+		case fields[0] == "hmac" && len(fields) == 4:
+			a.hmacKeys[fields[2]] = hmacKey{identity: fields[1], secret: []byte(fields[3])}
+		default:
+			return nil, fmt.Errorf("keyfile line %d: want \"apikey <identity> <key>\" or \"hmac <identity> <key-id> <secret>\"", line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read keyfile: %w", err)
+	}
+	if len(a.apiKeys) == 0 && len(a.hmacKeys) == 0 {
+		return nil, errors.New("keyfile has no credentials")
+	}
+	return a, nil
+}
+
+func newAuthenticator(skew time.Duration) *authenticator {
+	if skew <= 0 {
+		skew = defaultAuthSkew
+	}
+	return &authenticator{
+		apiKeys:  make(map[[sha256.Size]byte]string),
+		hmacKeys: make(map[string]hmacKey),
+		skew:     skew,
+		now:      time.Now,
+		public:   map[string]bool{"/health": true, "/ready": true},
+		seen:     make(map[string]time.Time),
+	}
+}
+
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.public[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, scheme, err := a.authenticate(w, r)
+		var p *problem.Problem
+		if errors.As(err, &p) {
+			problem.Write(w, p)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="orders"`)
+			writeError(w, problem.CodeUnauthorized, err.Error())
+			return
+		}
+		ctx, c := withCaller(r.Context())
+		c.Identity, c.Scheme = identity, scheme
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *authenticator) authenticate(w http.ResponseWriter, r *http.Request) (string, string, error) {
+	if keyID := r.Header.Get(headerKeyID); keyID != "" {
+		identity, err := a.verifySignature(w, r, keyID)
+		return identity, "hmac", err
+	}
+	key := r.Header.Get("X-API-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = bearer
+	}
+	if key == "" {
+		return "", "", errors.New("missing credentials")
+	}
+	identity, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", "", errors.New("invalid API key")
+	}
+	return identity, "apikey", nil
+}
+
+// verifySignature checks X-Signature, the hex HMAC-SHA256 of
+// stringToSign, and refuses stale timestamps and reused nonces. The body is
+// read up to the largest any route accepts, an import; a longer one fails
+// with a problem instead of a bad signature.
+func (a *authenticator) verifySignature(w http.ResponseWriter, r *http.Request, keyID string) (string, error) {
+	key, ok := a.hmacKeys[keyID]
+	if !ok {
+		return "", errors.New("unknown key id")
+	}
+	ts, nonce := r.Header.Get(headerTimestamp), r.Header.Get(headerNonce)
+	if nonce == "" {
+		return "", fmt.Errorf("%s is required", headerNonce)
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s must be unix seconds", headerTimestamp)
+	}
+	now := a.now()
+	if d := now.Sub(time.Unix(unix, 0)); d > a.skew || d < -a.skew {
+		return "", errors.New("timestamp outside the allowed clock skew")
+	}
+
+	body, p := bufferBody(w, r, maxImportBytes)
+	if p != nil {
+		return "", p
+	}
+
+	want := signRequest(key.secret, r.Method, r.URL.RequestURI(), ts, nonce, body)
+	got, err := hex.DecodeString(r.Header.Get(headerSignature))
+	if err != nil || !hmac.Equal(got, want) {
+		return "", errors.New("bad signature")
+	}
+	if !a.remember(keyID+"\x00"+nonce, now) {
+		return "", errors.New("replayed request")
+	}
+	return key.identity, nil
+}
+
+// remember records a nonce and reports whether it was new. A nonce only has
+// to be kept while its timestamp could still pass the skew check.
+func (a *authenticator) remember(nonce string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for len(a.order) > 0 && now.Sub(a.seen[a.order[0]]) > 2*a.skew {
+		delete(a.seen, a.order[0])
+		a.order = a.order[1:]
+	}
+	if _, ok := a.seen[nonce]; ok {
+		return false
+	}
+	a.seen[nonce] = now
+	a.order = append(a.order, nonce)
+	return true
+}
+
+func stringToSign(method, uri, ts, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{method, uri, ts, nonce, hex.EncodeToString(sum[:])}, "\n")
+}
+
+func signRequest(secret []byte, method, uri, ts, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign(method, uri, ts, nonce, body)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuth(t *testing.T) (*authenticator, *time.Time) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	keys := "# test credentials\napikey alice key-alice\nhmac billing kid-1 s3cret\n"
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := loadKeyfile(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_800_000_000, 0)
+	auth.now = func() time.Time { return now }
+	return auth, &now
+}
+
+func signed(method, uri, body string, at time.Time, nonce string) []string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	sig := signRequest([]byte("s3cret"), method, uri, ts, nonce, []byte(body))
+	return []string{headerKeyID, "kid-1", headerTimestamp, ts, headerNonce, nonce, headerSignature, hex.EncodeToString(sig)}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	auth, _ := testAuth(t)
+	h := buildHandler(newMemStore(), options{Auth: auth})
+
+	if rec := do(t, h, http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Fatalf("health: status = %d, want 200 without credentials", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/orders", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no credentials: status = %d, want 401", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/orders", "", "Authorization", "Bearer nope"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("bad key: status = %d, want 401", rec.Code)
+	}
+
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`, "X-API-Key", "key-alice")
+	rec := do(t, h, http.MethodPost, "/orders/1001/transitions", `{"to":"paid","actor":"mallory"}`, "Authorization", "Bearer key-alice")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("transition: status = %d body=%s", rec.Code, rec.Body)
+	}
+	if ord := decode[order](t, rec); ord.History[0].Actor != "alice" {
+		t.Fatalf("actor = %q, want the authenticated alice", ord.History[0].Actor)
+	}
+}
+
+func TestSignedRequestAuth(t *testing.T) {
+	auth, now := testAuth(t)
+	h := buildHandler(newMemStore(), options{Auth: auth})
+	body := `{"item":"latte","price":28}`
+
+	ok := signed(http.MethodPost, "/orders", body, *now, "n1")
+	if rec := do(t, h, http.MethodPost, "/orders", body, ok...); rec.Code != http.StatusCreated {
+		t.Fatalf("signed: status = %d body=%s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, http.MethodPost, "/orders", body, ok...); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("replay: status = %d, want 401", rec.Code)
+	}
+
+	tampered := signed(http.MethodPost, "/orders", body, *now, "n2")
+	if rec := do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":1}`, tampered...); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("tampered body: status = %d, want 401", rec.Code)
+	}
+
+	stale := signed(http.MethodGet, "/orders", "", now.Add(-2*time.Minute), "n3")
+	if rec := do(t, h, http.MethodGet, "/orders", "", stale...); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("stale timestamp: status = %d, want 401", rec.Code)
+	}
+
+	// Nonces are forgotten only once their timestamps could no longer pass.
+	*now = now.Add(3 * time.Minute)
+	fresh := signed(http.MethodGet, "/orders?limit=1", "", *now, "n1")
+	if rec := do(t, h, http.MethodGet, "/orders?limit=1", "", fresh...); rec.Code != http.StatusOK {
+		t.Fatalf("fresh request reusing an expired nonce: status = %d body=%s", rec.Code, rec.Body)
+	}
+	if len(auth.seen) != 1 {
+		t.Fatalf("seen nonces = %d, want old ones swept", len(auth.seen))
+	}
+}
+
+func TestSignedRequestBodyLimit(t *testing.T) {
+	auth, now := testAuth(t)
+	h := buildHandler(newMemStore(), options{Auth: auth})
+
+	// Imports accept far more than a JSON body; blank lines pad this one
+	// past a mebibyte.
+	body := `{"item":"latte","price":28}` + strings.Repeat("\n", 1<<20) + `{"item":"tea","price":12}` + "\n"
+	headers := append(signed(http.MethodPost, "/orders:import", body, *now, "n1"), "Content-Type", "application/x-ndjson")
+	rec := do(t, h, http.MethodPost, "/orders:import", body, headers...)
+	if rep := decode[importReport](t, rec); rec.Code != http.StatusOK || rep.Created != 2 {
+		t.Fatalf("large signed import: status = %d body=%s", rec.Code, rec.Body)
+	}
+
+	body = strings.Repeat("\n", maxImportBytes+1)
+	headers = append(signed(http.MethodPost, "/orders:import", body, *now, "n2"), "Content-Type", "application/x-ndjson")
+	if rec := do(t, h, http.MethodPost, "/orders:import", body, headers...); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized signed import: status = %d, want 413", rec.Code)
+	}
+}
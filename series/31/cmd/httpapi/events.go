@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"learn-go/series/31/problem"
+)
+
+const (
+	defaultEventBacklog = 1000
+	defaultHeartbeat    = 15 * time.Second
+	// streamWriteTimeout bounds each write to a long response, so a client
+	// that stops reading is cut off instead of pinning its goroutine.
+	streamWriteTimeout = 10 * time.Second
+	subscriberBuffer   = 64
+)
+
+const (
+	eventCreated      = "order.created"
+	eventUpdated      = "order.updated"
+	eventTransitioned = "order.transitioned"
+	eventDeleted      = "order.deleted"
+)
+
+type orderEvent struct {
+	ID    uint64 `json:"id"`
+	Type  string `json:"type"`
+	At    string `json:"at"`
+	Order *order `json:"order,omitempty"`
+	// OrderID is set alone on deletes, where there is no order left to send.
+	OrderID int `json:"order_id"`
+}
+
+type subscriber struct {
+	ch chan orderEvent
+	// done is closed when the hub drops the subscriber: it fell behind, it
+	// left, or the server is shutting down.
+	done chan struct{}
+}
+
+var errHubClosed = errors.New("event stream is shutting down")
+
+// eventHub fans order events out to SSE streams and keeps the most recent
+// ones so a reconnecting client can resume from Last-Event-ID.
+type eventHub struct {
+	mu     sync.Mutex
+	size   int
+	log    []orderEvent
+	nextID uint64
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+func newEventHub(size int) *eventHub {
+	if size <= 0 {
+		size = defaultEventBacklog
+	}
+	return &eventHub{size: size, subs: make(map[*subscriber]struct{})}
+}
+
+// publish records an event and hands it to every subscriber. A subscriber
+// whose buffer is full is dropped rather than waited on; it can reconnect
+// and catch up from the log.
+func (h *eventHub) publish(typ string, ord order) {
+	ev := orderEvent{Type: typ, At: time.Now().Format(time.RFC3339), OrderID: ord.ID}
+	if typ != eventDeleted {
+		ev.Order = &ord
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	ev.ID = h.nextID
+	h.log = append(h.log, ev)
+	if len(h.log) >= 2*h.size {
+		h.log = append([]orderEvent(nil), h.log[len(h.log)-h.size:]...)
+	}
+	for s := range h.subs {
+		select {
+		case s.ch <- ev:
+		default:
+			h.drop(s)
+		}
+	}
+}
+
+// subscribe registers a stream and returns the retained events after last.
+// gap reports that a resuming client missed events the log no longer holds.
+func (h *eventHub) subscribe(last uint64, resume bool) (s *subscriber, backlog []orderEvent, gap bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil, false, errHubClosed
+	}
+	if resume {
+		kept := h.retained()
+		// An ID from the future was issued before a restart.
+		gap = last > h.nextID || (len(kept) > 0 && kept[0].ID > last+1)
+		if gap {
+			last = 0
+		}
+		for _, ev := range kept {
+			if ev.ID > last {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	s = &subscriber{ch: make(chan orderEvent, subscriberBuffer), done: make(chan struct{})}
+	h.subs[s] = struct{}{}
+	return s, backlog, gap, nil
+}
+
+func (h *eventHub) retained() []orderEvent {
+	if len(h.log) > h.size {
+		return h.log[len(h.log)-h.size:]
+	}
+	return h.log
+}
+
+func (h *eventHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(s)
+}
+
+func (h *eventHub) drop(s *subscriber) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.done)
+	}
+}
+
+// close ends every stream and refuses new ones. http.Server.Shutdown waits
+// for handlers to return, so streams have to be told to stop.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for s := range h.subs {
+		h.drop(s)
+	}
+}
+
+func (h *eventHub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func lastEventID(r *http.Request) (uint64, bool, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		// EventSource cannot set headers on the first connection.
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false, errors.New("Last-Event-ID must be a non-negative integer")
+	}
+	return id, true, nil
+}
+
+func (a *api) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	last, resume, err := lastEventID(r)
+	if err != nil {
+		writeError(w, problem.CodeBadRequest, err.Error())
+		return
+	}
+	sub, backlog, gap, err := a.events.subscribe(last, resume)
+	if err != nil {
+		writeError(w, problem.CodeUnavailable, err.Error())
+		return
+	}
+	defer a.events.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	send := func(format string, args ...any) bool {
+		// Recorders and some wrappers cannot set deadlines; the stream
+		// still works, just without the per-write bound.
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	sendEvent := func(ev orderEvent) bool {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return false
+		}
+		return send("id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !send("retry: %d\n\n", 3000) {
+		return
+	}
+	if gap && !send("event: reset\ndata: {\"reason\":\"events since Last-Event-ID were discarded; refetch GET /orders\"}\n\n") {
+		return
+	}
+	for _, ev := range backlog {
+		if !sendEvent(ev) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(a.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.done:
+			return
+		case ev := <-sub.ch:
+			if !sendEvent(ev) {
+				return
+			}
+		case <-heartbeat.C:
+			if !send(": heartbeat\n\n") {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readEvent returns the next event's fields, skipping comments.
+func readEvent(t *testing.T, br *bufio.Reader) map[string]string {
+	t.Helper()
+	ev := map[string]string{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if len(ev) > 0 {
+				return ev
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			ev["comment"] = line
+			continue
+		}
+		k, v, _ := strings.Cut(line, ": ")
+		ev[k] = v
+	}
+}
+
+func openStream(t *testing.T, ctx context.Context, url string, headers ...string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %q", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+	if ev := readEvent(t, br); ev["retry"] == "" {
+		t.Fatalf("first event = %v, want retry", ev)
+	}
+	return resp, br
+}
+
+func TestOrderEventStream(t *testing.T) {
+	hub := newEventHub(2)
+	h := buildHandler(newMemStore(), options{Events: hub, Heartbeat: 50 * time.Millisecond})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, br := openStream(t, ctx, srv.URL+"/orders/events")
+
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`)
+	do(t, h, http.MethodPost, "/orders/1001/transitions", `{"to":"paid","actor":"cashier"}`)
+	if ev := readEvent(t, br); ev["event"] != eventCreated || ev["id"] != "1" || !strings.Contains(ev["data"], `"item":"latte"`) {
+		t.Fatalf("first event = %v", ev)
+	}
+	if ev := readEvent(t, br); ev["event"] != eventTransitioned || ev["id"] != "2" {
+		t.Fatalf("second event = %v", ev)
+	}
+	if ev := readEvent(t, br); ev["comment"] != ": heartbeat" {
+		t.Fatalf("idle stream sent %v, want a heartbeat", ev)
+	}
+
+	cancel()
+	resp.Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.subscribers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber not released after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	do(t, h, http.MethodDelete, "/orders/1001", "")
+	resp, br = openStream(t, context.Background(), srv.URL+"/orders/events", "Last-Event-ID", "2")
+	if ev := readEvent(t, br); ev["event"] != eventDeleted || ev["id"] != "3" {
+		t.Fatalf("resumed event = %v", ev)
+	}
+	resp.Body.Close()
+
+	// Only two events are kept, so resuming from 0 has lost event 1.
+	resp, br = openStream(t, context.Background(), srv.URL+"/orders/events?last_event_id=0")
+	if ev := readEvent(t, br); ev["event"] != "reset" {
+		t.Fatalf("resume past the backlog = %v, want reset", ev)
+	}
+	if ev := readEvent(t, br); ev["id"] != "2" {
+		t.Fatalf("after reset = %v, want the oldest kept event", ev)
+	}
+	if ev := readEvent(t, br); ev["id"] != "3" {
+		t.Fatalf("after reset = %v, want event 3", ev)
+	}
+
+	hub.close()
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Fatal("stream still open after hub close")
+	}
+	resp.Body.Close()
+	if rec := do(t, h, http.MethodGet, "/orders/events", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("subscribe after close: status = %d, want 503", rec.Code)
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	hub := newEventHub(10)
+	sub, _, _, err := hub.subscribe(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= subscriberBuffer; i++ {
+		hub.publish(eventCreated, order{ID: i})
+	}
+	select {
+	case <-sub.done:
+	default:
+		t.Fatal("subscriber with a full buffer was not dropped")
+	}
+	if hub.subscribers() != 0 {
+		t.Fatalf("subscribers = %d, want 0", hub.subscribers())
+	}
+	if got := len(hub.retained()); got != 10 {
+		t.Fatalf("retained = %d, want 10", got)
+	}
+}
+
+// laggingStore returns from Update a little later for each older version,
+// which widens the gap between a write and its event.
+type laggingStore struct{ Store }
+
+func (s laggingStore) Update(id int, fn func(*order) error) (order, error) {
+	ord, err := s.Store.Update(id, fn)
+	time.Sleep(time.Duration(ord.Version%4) * time.Millisecond)
+	return ord, err
+}
+
+func TestEventsFollowVersionOrder(t *testing.T) {
+	hub := newEventHub(0)
+	h := buildHandler(laggingStore{newMemStore()}, options{Events: hub})
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(t, h, http.MethodPatch, "/orders/1001", `{"discount_code":"OFF10"}`)
+		}()
+	}
+	wg.Wait()
+
+	version := 0
+	for _, ev := range hub.retained() {
+		if ev.Order.Version <= version {
+			t.Fatalf("event %d has version %d after version %d", ev.ID, ev.Order.Version, version)
+		}
+		version = ev.Order.Version
+	}
+	if version != 21 {
+		t.Fatalf("last version = %d, want 21", version)
+	}
+}
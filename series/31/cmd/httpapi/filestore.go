@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logFile          = "orders.log"
+	snapshotFile     = "orders.snapshot.json"
+	defaultSnapEvery = 100
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// logRecord is one line of the append-only log. Records are idempotent, so
+// replaying a log over a snapshot that already holds them is harmless.
+type logRecord struct {
+	Op     string `json:"op"`
+	Order  *order `json:"order,omitempty"`
+	ID     int    `json:"id,omitempty"`
+	NextID int    `json:"next_id"`
+}
+
+type snapshot struct {
+	NextID int     `json:"next_id"`
+	Orders []order `json:"orders"`
+}
+
+// fileStore keeps every order in memory and makes each change durable in an
+// append-only log before it becomes visible. Every snapEvery records the
+// whole table is written as a snapshot and the log starts over.
+type fileStore struct {
+	mu        sync.RWMutex
+	dir       string
+	table     orderTable
+	log       *os.File
+	records   int
+	snapEvery int
+}
+
+func openFileStore(dir string, snapEvery int) (*fileStore, error) {
+	if snapEvery <= 0 {
+		snapEvery = defaultSnapEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create store dir: %w", err)
+	}
+	s := &fileStore{dir: dir, table: newOrderTable(), snapEvery: snapEvery}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	for _, ord := range snap.Orders {
+		s.table.put(ord)
+	}
+	s.table.nextID = max(s.table.nextID, snap.NextID)
+	return nil
+}
+
+// replay applies the log on top of the snapshot and opens it for appending.
+// A torn last line from a crash mid-write is cut off; damage anywhere else
+// is an error.
+func (s *fileStore) replay() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// An unterminated last line never finished its write.
+			break
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("read log: %w", err)
+		}
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, peekErr := r.Peek(1); errors.Is(peekErr, io.EOF) {
+				break
+			}
+			f.Close()
+			return fmt.Errorf("log record at offset %d: %w", good, err)
+		}
+		s.apply(rec)
+		s.records++
+		good += int64(len(line))
+	}
+
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seek log: %w", err)
+	}
+	s.log = f
+	return nil
+}
+
+func (s *fileStore) apply(rec logRecord) {
+	switch rec.Op {
+	case opPut:
+		if rec.Order != nil {
+			s.table.put(*rec.Order)
+		}
+	case opDelete:
+		delete(s.table.items, rec.ID)
+	}
+	s.table.nextID = max(s.table.nextID, rec.NextID)
+}
+
+// append makes rec durable, then applies it. A failed write is cut back off
+// the log so the next record does not land after a torn line. The caller
+// holds s.mu.
+func (s *fileStore) append(rec logRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode log record: %w", err)
+	}
+	if err := s.write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.apply(rec)
+	s.records++
+	// A failed snapshot leaves the log whole, so it is simply tried again
+	// after the next record.
+	if s.records >= s.snapEvery {
+		_ = s.snapshot()
+	}
+	return nil
+}
+
+func (s *fileStore) write(line []byte) error {
+	offset, err := s.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("seek log: %w", err)
+	}
+	_, err = s.log.Write(line)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		_ = s.log.Truncate(offset)
+		_, _ = s.log.Seek(offset, io.SeekStart)
+		return fmt.Errorf("write log: %w", err)
+	}
+	return nil
+}
+
+// snapshot writes the table to a temp file, renames it into place and only
+// then empties the log, so a crash at any point leaves a recoverable pair.
+func (s *fileStore) snapshot() error {
+	data, err := json.Marshal(snapshot{NextID: s.table.nextID, Orders: s.table.list()})
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+	path := filepath.Join(s.dir, snapshotFile)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	if err := s.log.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek log: %w", err)
+	}
+	s.records = 0
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileStore) Create(ord order) (order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ord.ID, ord.Version = s.table.nextID+1, 1
+	if err := s.append(logRecord{Op: opPut, Order: &ord, NextID: ord.ID}); err != nil {
+		return order{}, err
+	}
+	return ord, nil
+}
+
+func (s *fileStore) Get(id int) (order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ord, ok := s.table.items[id]
+	if !ok {
+		return order{}, errNotFound
+	}
+	return ord, nil
+}
+
+func (s *fileStore) List(q listQuery) (orderPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.table.query(q), nil
+}
+
+func (s *fileStore) Update(id int, fn func(*order) error) (order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ord, err := s.table.updated(id, fn)
+	if err != nil {
+		return order{}, err
+	}
+	if err := s.append(logRecord{Op: opPut, Order: &ord, NextID: s.table.nextID}); err != nil {
+		return order{}, err
+	}
+	return ord, nil
+}
+
+func (s *fileStore) Delete(id int, check func(order) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.table.deletable(id, check); err != nil {
+		return err
+	}
+	return s.append(logRecord{Op: opDelete, ID: id, NextID: s.table.nextID})
+}
+
+// Close writes a final snapshot so the next start has no log to replay.
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	err := s.snapshot()
+	if closeErr := s.log.Close(); err == nil {
+		err = closeErr
+	}
+	s.log = nil
+	return err
+}
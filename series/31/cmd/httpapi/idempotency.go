@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"learn-go/series/31/problem"
+)
+
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKey     = 255
+)
+
+type idemEntry struct {
+	key         string
+	fingerprint string
+	pending     bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyStore remembers responses by Idempotency-Key. All entries live
+// for the same TTL, so the insertion-ordered queue is also expiry order.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]*idemEntry
+	queue   []*idemEntry
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return &idempotencyStore{ttl: ttl, now: time.Now, entries: make(map[string]*idemEntry)}
+}
+
+// begin claims key for a new request. When a previous request holds the key
+// it returns a copy of that entry and a nil claim instead.
+func (s *idempotencyStore) begin(key, fingerprint string) (idemEntry, *idemEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for len(s.queue) > 0 && now.After(s.queue[0].expires) {
+		if s.entries[s.queue[0].key] == s.queue[0] {
+			delete(s.entries, s.queue[0].key)
+		}
+		s.queue = s.queue[1:]
+	}
+	if e, ok := s.entries[key]; ok && (e.pending || !now.After(e.expires)) {
+		return *e, nil
+	}
+	e := &idemEntry{key: key, fingerprint: fingerprint, pending: true}
+	s.entries[key] = e
+	return idemEntry{}, e
+}
+
+// forget drops a claim whose request failed, so a retry runs it again.
+func (s *idempotencyStore) forget(e *idemEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries[e.key] == e {
+		delete(s.entries, e.key)
+	}
+}
+
+func (s *idempotencyStore) finish(e *idemEntry, rec *responseCapture) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.pending = false
+	e.status, e.header, e.body = rec.status, rec.header, rec.body.Bytes()
+	e.expires = s.now().Add(s.ttl)
+	s.queue = append(s.queue, e)
+}
+
+// idempotent runs next at most once per Idempotency-Key. A repeat with the
+// same request gets the stored response back; a repeat with a different one
+// is refused with 422. Requests without the header run as usual.
+func (a *api) idempotent(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		next(w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		writeError(w, problem.CodeBadRequest, fmt.Sprintf("Idempotency-Key is longer than %d bytes", maxIdempotencyKey))
+		return
+	}
+
+	body, p := bufferBody(w, r, maxJSONBytes)
+	if p != nil {
+		problem.Write(w, p)
+		return
+	}
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + string(body)))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// Keys are per caller, so one client cannot replay another's response.
+	prev, entry := a.idem.begin(identityFrom(r.Context())+"\x00"+key, fingerprint)
+	switch {
+	case entry != nil:
+	case prev.fingerprint != fingerprint:
+		writeError(w, problem.CodeIdempotencyKeyReused, "Idempotency-Key was already used for a different request")
+		return
+	case prev.pending:
+		writeError(w, problem.CodeIdempotencyInProgress, "a request with this Idempotency-Key is still in progress")
+		return
+	default:
+		for k, v := range prev.header {
+			// The replay keeps this request's own ID.
+			if k != problem.RequestIDHeader {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(prev.status)
+		_, _ = w.Write(prev.body)
+		return
+	}
+
+	rec := &responseCapture{header: w.Header().Clone(), status: http.StatusOK}
+	defer func() {
+		if p := recover(); p != nil {
+			a.idem.forget(entry)
+			panic(p)
+		}
+	}()
+	next(rec, r)
+
+	// A server error is not a result worth replaying; let the retry run.
+	if rec.status >= http.StatusInternalServerError {
+		a.idem.forget(entry)
+	} else {
+		a.idem.finish(entry, rec)
+	}
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.status)
+	_, _ = w.Write(rec.body.Bytes())
+}
+
+type responseCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) Header() http.Header {
+	return c.header
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	return c.body.Write(p)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	store := newMemStore()
+	h := buildHandler(store, options{IdempotencyTTL: time.Minute})
+	body := `{"item":"latte","price":28}`
+
+	first := do(t, h, http.MethodPost, "/orders", body, "Idempotency-Key", "k1")
+	again := do(t, h, http.MethodPost, "/orders", body, "Idempotency-Key", "k1")
+	if first.Code != http.StatusCreated || again.Code != http.StatusCreated {
+		t.Fatalf("status = %d then %d, want 201 twice", first.Code, again.Code)
+	}
+	if again.Body.String() != first.Body.String() || again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry was not a replay: %s", again.Body)
+	}
+	if page, _ := store.List(listQuery{}); len(page.Orders) != 1 {
+		t.Fatalf("orders = %d, want 1", len(page.Orders))
+	}
+
+	if rec := do(t, h, http.MethodPost, "/orders", `{"item":"tea","price":12}`, "Idempotency-Key", "k1"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key: status = %d, want 422", rec.Code)
+	}
+	do(t, h, http.MethodPost, "/orders", body)
+	if page, _ := store.List(listQuery{}); len(page.Orders) != 2 {
+		t.Fatalf("request without a key was not created")
+	}
+}
+
+func TestIdempotencyKeyBodyLimit(t *testing.T) {
+	h := buildHandler(newMemStore(), options{IdempotencyTTL: time.Minute})
+	body := `{"item":"latte","price":28}` + strings.Repeat(" ", maxJSONBytes)
+	if rec := do(t, h, http.MethodPost, "/orders", body, "Idempotency-Key", "k1"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body: status = %d, want 413", rec.Code)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	s := newIdempotencyStore(time.Minute)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	_, claim := s.begin("k", "a")
+	s.finish(claim, &responseCapture{status: http.StatusCreated})
+	if prev, claim := s.begin("k", "a"); claim != nil || prev.status != http.StatusCreated {
+		t.Fatal("entry should still be replayed within the TTL")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, claim := s.begin("k", "b"); claim == nil {
+		t.Fatal("expired key should be free again")
+	}
+	if len(s.queue) != 0 {
+		t.Fatalf("queue = %d, want expired entries swept", len(s.queue))
+	}
+}
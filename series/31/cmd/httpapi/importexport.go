@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"learn-go/series/31/problem"
+)
+
+const (
+	maxImportBytes  = 32 << 20
+	maxImportErrors = 100
+	exportPageSize  = maxPageSize
+)
+
+// csvColumns is the export layout: one row per line item, with the order's
+// totals repeated on each. Import reads item and price and, when present,
+// quantity, discount_code and order; the other columns are ignored.
+var csvColumns = []string{"order", "item", "price", "quantity", "discount_code", "status", "subtotal", "discount", "total", "created_at"}
+
+type importRowError struct {
+	Line   int                  `json:"line"`
+	Error  string               `json:"error"`
+	Fields []problem.FieldError `json:"fields,omitempty"`
+}
+
+type importReport struct {
+	Created         int              `json:"created"`
+	Failed          int              `json:"failed"`
+	Errors          []importRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated,omitempty"`
+}
+
+func (rep *importReport) fail(line int, err error) {
+	rep.Failed++
+	if len(rep.Errors) == maxImportErrors {
+		rep.ErrorsTruncated = true
+		return
+	}
+	rowErr := importRowError{Line: line, Error: err.Error()}
+	var fields problem.FieldErrors
+	if errors.As(err, &fields) {
+		rowErr.Fields = fields
+	}
+	rep.Errors = append(rep.Errors, rowErr)
+}
+
+// rowError is a problem with one input row; the import moves on to the
+// next. Any other error from a source ends the import.
+type rowError struct{ err error }
+
+func (e *rowError) Error() string { return e.err.Error() }
+
+func (e *rowError) Unwrap() error { return e.err }
+
+type importSource interface {
+	// next returns the next order and the input line it starts on, or
+	// io.EOF after the last one.
+	next() (createOrderRequest, int, error)
+}
+
+func newImportSource(r *http.Request) (importSource, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return newCSVSource(r.Body)
+	case "application/x-ndjson", "application/ndjson":
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+		return &ndjsonSource{sc: sc}, nil
+	}
+	return nil, errUnsupportedMedia
+}
+
+var errUnsupportedMedia = errors.New("Content-Type must be text/csv or application/x-ndjson")
+
+type ndjsonSource struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+// next decodes one create request per line. Fields it does not know are
+// ignored so exported orders import as they are; when items are given, the
+// item and price summary is ignored too.
+func (s *ndjsonSource) next() (createOrderRequest, int, error) {
+	for s.sc.Scan() {
+		s.line++
+		text := bytes.TrimSpace(s.sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var req createOrderRequest
+		if err := json.Unmarshal(text, &req); err != nil {
+			return req, s.line, &rowError{fmt.Errorf("invalid json: %w", err)}
+		}
+		if len(req.Items) > 0 {
+			req.Item, req.Price = "", 0
+		}
+		return req, s.line, nil
+	}
+	if err := s.sc.Err(); err != nil {
+		return createOrderRequest{}, s.line + 1, err
+	}
+	return createOrderRequest{}, s.line, io.EOF
+}
+
+type csvRecord struct {
+	fields []string
+	line   int
+	err    error
+}
+
+type csvSource struct {
+	r       *csv.Reader
+	cols    map[string]int
+	pending *csvRecord
+}
+
+func newCSVSource(body io.Reader) (*csvSource, error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read csv header: %w", err)
+	}
+	s := &csvSource{r: r, cols: make(map[string]int)}
+	for i, name := range header {
+		s.cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"item", "price"} {
+		if _, ok := s.cols[name]; !ok {
+			return nil, fmt.Errorf("csv header needs an %q column", name)
+		}
+	}
+	return s, nil
+}
+
+func (s *csvSource) read() csvRecord {
+	if rec := s.pending; rec != nil {
+		s.pending = nil
+		return *rec
+	}
+	fields, err := s.r.Read()
+	var perr *csv.ParseError
+	switch {
+	case errors.As(err, &perr):
+		return csvRecord{line: perr.StartLine, err: &rowError{err}}
+	case err != nil:
+		return csvRecord{err: err}
+	}
+	line, _ := s.r.FieldPos(0)
+	return csvRecord{fields: fields, line: line}
+}
+
+func (s *csvSource) field(fields []string, name string) string {
+	if i, ok := s.cols[name]; ok && i < len(fields) {
+		return strings.TrimSpace(fields[i])
+	}
+	return ""
+}
+
+// next reads one order. Consecutive rows with the same non-empty order
+// value are the line items of a single order.
+func (s *csvSource) next() (createOrderRequest, int, error) {
+	first := s.read()
+	if first.err != nil {
+		return createOrderRequest{}, first.line, first.err
+	}
+	group := [][]string{first.fields}
+	if ref := s.field(first.fields, "order"); ref != "" {
+		for {
+			rec := s.read()
+			if rec.err != nil || s.field(rec.fields, "order") != ref {
+				s.pending = &rec
+				break
+			}
+			group = append(group, rec.fields)
+		}
+	}
+	req, err := s.parse(group)
+	if err != nil {
+		return req, first.line, &rowError{err}
+	}
+	return req, first.line, nil
+}
+
+func (s *csvSource) parse(group [][]string) (createOrderRequest, error) {
+	var req createOrderRequest
+	for i, fields := range group {
+		li := lineItem{Name: s.field(fields, "item")}
+		price, err := strconv.Atoi(s.field(fields, "price"))
+		if err != nil {
+			return req, fmt.Errorf("row %d of order: price must be an integer", i+1)
+		}
+		li.UnitPrice = price
+		if raw := s.field(fields, "quantity"); raw != "" {
+			if li.Quantity, err = strconv.Atoi(raw); err != nil {
+				return req, fmt.Errorf("row %d of order: quantity must be an integer", i+1)
+			}
+		}
+		code := s.field(fields, "discount_code")
+		if i > 0 && code != req.DiscountCode {
+			return req, errors.New("rows of one order have different discount codes")
+		}
+		req.DiscountCode = code
+		req.Items = append(req.Items, li)
+	}
+	return req, nil
+}
+
+// handleImport creates orders from a CSV or NDJSON body, reporting each
+// rejected row. With atomic=true any rejected row means nothing is created.
+func (a *api) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	atomic := false
+	if raw := r.URL.Query().Get("atomic"); raw != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, problem.CodeInvalidQuery, "atomic must be true or false")
+			return
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	defer r.Body.Close()
+	src, err := newImportSource(r)
+	if errors.Is(err, errUnsupportedMedia) {
+		writeError(w, problem.CodeUnsupportedMediaType, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, problem.CodeBadRequest, err.Error())
+		return
+	}
+
+	rep := importReport{Errors: []importRowError{}}
+	var stopped *problem.Problem
+	var staged []order
+	for {
+		req, line, err := src.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *rowError
+		if err != nil && !errors.As(err, &rowErr) {
+			stopped = problem.New(problem.CodeBadRequest, fmt.Sprintf("import stopped at line %d", line))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				stopped = problem.New(problem.CodePayloadTooLarge, fmt.Sprintf("body exceeds %d bytes", maxImportBytes))
+			}
+			rep.fail(line, err)
+			break
+		}
+		if err != nil {
+			rep.fail(line, err)
+			continue
+		}
+		ord, err := orderFromRequest(req)
+		if err != nil {
+			rep.fail(line, err)
+			continue
+		}
+		if atomic {
+			staged = append(staged, ord)
+			continue
+		}
+		if _, err := a.commit(eventCreated, func() (order, error) { return a.store.Create(ord) }); err != nil {
+			rep.fail(line, err)
+			continue
+		}
+		rep.Created++
+	}
+
+	if atomic && stopped == nil && rep.Failed > 0 {
+		stopped = problem.New(problem.CodeImportRejected, fmt.Sprintf("%d rows were rejected, so nothing was imported", rep.Failed))
+	}
+	if stopped != nil {
+		problem.Write(w, stopped.With("report", rep))
+		return
+	}
+	if atomic {
+		if err := a.createAll(staged); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		rep.Created = len(staged)
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func orderFromRequest(req createOrderRequest) (order, error) {
+	lines, err := orderLines(req)
+	if err != nil {
+		return order{}, err
+	}
+	return newOrder(lines, req.DiscountCode)
+}
+
+// createAll stores every order or, if the store fails part way, deletes the
+// ones already created. Events go out only once all of them are in, and no
+// other write is let in between, as in commit.
+func (a *api) createAll(orders []order) error {
+	a.writes.Lock()
+	defer a.writes.Unlock()
+
+	created := make([]order, 0, len(orders))
+	for _, ord := range orders {
+		ord, err := a.store.Create(ord)
+		if err != nil {
+			for _, c := range created {
+				_ = a.store.Delete(c.ID, nil)
+			}
+			return fmt.Errorf("import rolled back: %w", err)
+		}
+		created = append(created, ord)
+	}
+	for _, ord := range created {
+		a.events.publish(eventCreated, ord)
+	}
+	return nil
+}
+
+// handleExport streams orders a page at a time, so memory stays bounded by
+// the page size however many orders match. The list filters and sort
+// apply; limit and cursor do not.
+func (a *api) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "csv" && format != "ndjson" {
+		writeError(w, problem.CodeInvalidQuery, "format must be csv or ndjson")
+		return
+	}
+	params.Del("limit")
+	params.Del("cursor")
+	q, err := parseListQuery(params)
+	if err != nil {
+		writeError(w, problem.CodeInvalidQuery, err.Error())
+		return
+	}
+	q.Limit = exportPageSize
+
+	page, err := a.store.List(q)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	var write func(order) error
+	var flush func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		_ = cw.Write(csvColumns)
+		write = func(ord order) error { return writeCSVOrder(cw, ord) }
+		flush = func() error { cw.Flush(); return cw.Error() }
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(ord order) error { return enc.Encode(ord) }
+		flush = func() error { return nil }
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="orders.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	for {
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		for _, ord := range page.Orders {
+			if err := write(ord); err != nil {
+				return
+			}
+		}
+		if err := flush(); err != nil || rc.Flush() != nil {
+			return
+		}
+		if page.NextCursor == "" || r.Context().Err() != nil {
+			return
+		}
+		c, _ := decodeCursor(page.NextCursor)
+		q.Cursor = &c
+		if page, err = a.store.List(q); err != nil {
+			// The status is already sent; a truncated body is all that
+			// can signal the failure.
+			fmt.Fprintf(os.Stderr, "export rid=%s: %v\n", w.Header().Get(problem.RequestIDHeader), err)
+			return
+		}
+	}
+}
+
+func writeCSVOrder(cw *csv.Writer, ord order) error {
+	id := strconv.Itoa(ord.ID)
+	for _, li := range ord.lines() {
+		row := []string{
+			id, li.Name, strconv.Itoa(li.UnitPrice), strconv.Itoa(li.Quantity), ord.DiscountCode, ord.Status,
+			strconv.Itoa(ord.Pricing.Subtotal), strconv.Itoa(ord.Pricing.Discount), strconv.Itoa(ord.Pricing.Total), ord.CreatedAt,
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
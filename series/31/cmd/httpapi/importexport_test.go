@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"learn-go/series/31/problem"
+)
+
+func TestImportRowErrors(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	body := "order,item,price,quantity,discount_code\n" +
+		"a,latte,28,2,OFF10\n" +
+		"a,croissant,16,,OFF10\n" +
+		",tea,12,,\n" +
+		",bad,x,,\n" +
+		"b,cake,20,,FREE\n"
+
+	rec := do(t, h, http.MethodPost, "/orders:import?atomic=true", body, "Content-Type", "text/csv")
+	rejected := decode[struct {
+		Code   problem.Code
+		Report importReport
+	}](t, rec)
+	if rec.Code != http.StatusUnprocessableEntity || rejected.Code != problem.CodeImportRejected || rejected.Report.Failed != 2 {
+		t.Fatalf("atomic: status = %d body=%s", rec.Code, rec.Body)
+	}
+	if page := decode[orderPage](t, do(t, h, http.MethodGet, "/orders", "")); len(page.Orders) != 0 {
+		t.Fatalf("atomic import with bad rows created %d orders", len(page.Orders))
+	}
+
+	rec = do(t, h, http.MethodPost, "/orders:import", body, "Content-Type", "text/csv")
+	rep := decode[importReport](t, rec)
+	if rec.Code != http.StatusOK || rep.Created != 2 || rep.Failed != 2 {
+		t.Fatalf("import: status = %d report=%+v", rec.Code, rep)
+	}
+	if rep.Errors[0].Line != 5 || rep.Errors[1].Line != 6 || !strings.Contains(rep.Errors[1].Error, "FREE") {
+		t.Fatalf("row errors = %+v, want lines 5 and 6", rep.Errors)
+	}
+	ord := decode[order](t, do(t, h, http.MethodGet, "/orders/1001", ""))
+	if len(ord.Items) != 2 || ord.Pricing.Total != 64 {
+		t.Fatalf("grouped order = %+v", ord)
+	}
+
+	if rec := do(t, h, http.MethodPost, "/orders:import", `{"item":"tea","price":12}`, "Content-Type", "application/json"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("json body: status = %d, want 415", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/orders:import", "name,cost\n", "Content-Type", "text/csv"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad header: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	src := buildHandler(newMemStore(), options{})
+	var ndjson strings.Builder
+	for i := 1; i <= exportPageSize+50; i++ {
+		fmt.Fprintf(&ndjson, `{"items":[{"name":"item-%d","unit_price":%d,"quantity":2}]}`+"\n", i, i)
+	}
+	rec := do(t, src, http.MethodPost, "/orders:import", ndjson.String(), "Content-Type", "application/x-ndjson")
+	if rep := decode[importReport](t, rec); rep.Created != exportPageSize+50 {
+		t.Fatalf("seed import = %+v", rep)
+	}
+
+	rec = do(t, src, http.MethodGet, "/orders:export?format=csv&min_price=20", "")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("content type = %q", ct)
+	}
+	rows, err := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Totals are twice the unit price, so min_price=20 drops items 1 to 9.
+	if want := exportPageSize + 50 - 9; len(rows)-1 != want {
+		t.Fatalf("csv rows = %d, want %d across pages", len(rows)-1, want)
+	}
+
+	dst := buildHandler(newMemStore(), options{})
+	rec = do(t, dst, http.MethodPost, "/orders:import?atomic=true", rec.Body.String(), "Content-Type", "text/csv")
+	if rep := decode[importReport](t, rec); rep.Created != len(rows)-1 || rep.Failed != 0 {
+		t.Fatalf("reimport csv = %+v", rep)
+	}
+
+	rec = do(t, src, http.MethodGet, "/orders:export?format=ndjson&sort=-price", "")
+	sc := bufio.NewScanner(rec.Body)
+	lines := 0
+	for sc.Scan() {
+		lines++
+	}
+	if lines != exportPageSize+50 {
+		t.Fatalf("ndjson lines = %d", lines)
+	}
+	if rec := do(t, src, http.MethodGet, "/orders:export?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("xml: status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"learn-go/series/31/problem"
+)
+
+const (
+	statusCreated   = "created"
+	statusPaid      = "paid"
+	statusShipped   = "shipped"
+	statusDelivered = "delivered"
+	statusCanceled  = "canceled"
+	statusRefunded  = "refunded"
+)
+
+// nextStatuses is the order lifecycle. Canceled and refunded are final.
+var nextStatuses = map[string][]string{
+	statusCreated:   {statusPaid, statusCanceled},
+	statusPaid:      {statusShipped, statusRefunded},
+	statusShipped:   {statusDelivered},
+	statusDelivered: {statusRefunded},
+	statusCanceled:  {},
+	statusRefunded:  {},
+}
+
+type transition struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	At    string `json:"at"`
+	Actor string `json:"actor"`
+}
+
+type transitionRequest struct {
+	To    string `json:"to"`
+	Actor string `json:"actor"`
+}
+
+// transitionError reports a move the lifecycle does not allow, along with
+// the moves it does.
+type transitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *transitionError) Error() string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("order is %s, which is final", e.From)
+	}
+	return fmt.Sprintf("cannot move order from %s to %s; allowed: %s", e.From, e.To, strings.Join(e.Allowed, ", "))
+}
+
+func (ord *order) transition(to, actor string, at time.Time) error {
+	from := ord.Status
+	if from == "" {
+		// Orders stored before statuses existed start out created.
+		from = statusCreated
+	}
+	allowed := nextStatuses[from]
+	for _, next := range allowed {
+		if next == to {
+			ord.Status = to
+			ord.History = append(ord.History, transition{
+				From:  from,
+				To:    to,
+				At:    at.Format(time.RFC3339),
+				Actor: actor,
+			})
+			return nil
+		}
+	}
+	return &transitionError{From: from, To: to, Allowed: allowed}
+}
+
+func (a *api) handleTransitions(w http.ResponseWriter, r *http.Request, id int) {
+	switch r.Method {
+	case http.MethodGet:
+		ord, err := a.store.Get(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ord.History)
+	case http.MethodPost:
+		var req transitionRequest
+		if err := readJSON(r, &req); err != nil {
+			problem.Write(w, problem.DecodeError(err))
+			return
+		}
+		if _, ok := nextStatuses[req.To]; !ok {
+			problem.Write(w, problem.Invalid(problem.FieldErrors{{Field: "to", Message: fmt.Sprintf("unknown status %q", req.To)}}))
+			return
+		}
+		// An authenticated caller is the actor; anyone else has to name one.
+		if identity := identityFrom(r.Context()); identity != "" {
+			req.Actor = identity
+		}
+		if req.Actor == "" {
+			problem.Write(w, problem.Invalid(problem.FieldErrors{{Field: "actor", Message: "is required"}}))
+			return
+		}
+		a.updateOrder(w, r, id, eventTransitioned, func(ord *order) error {
+			return ord.transition(req.To, req.Actor, time.Now())
+		})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeMethodNotAllowed(w, r)
+	}
+}
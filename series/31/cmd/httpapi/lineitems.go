@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"learn-go/series/31/problem"
+	"learn-go/series/34/pricing"
+)
+
+const (
+	maxLineItems = 100
+	// maxUnitPrice and maxQuantity keep a full order's subtotal well inside
+	// an int: 100 lines of the largest price and quantity total 1e17.
+	maxUnitPrice = 1_000_000_000
+	maxQuantity  = 1_000_000
+)
+
+type lineItem struct {
+	Name      string `json:"name"`
+	UnitPrice int    `json:"unit_price"`
+	Quantity  int    `json:"quantity"`
+}
+
+type priceBreakdown struct {
+	Subtotal     int    `json:"subtotal"`
+	DiscountKind string `json:"discount_kind,omitempty"`
+	Discount     int    `json:"discount"`
+	Total        int    `json:"total"`
+}
+
+var (
+	errMultipleItems = errors.New("order has several line items; patch items instead of item and price")
+	errPriceNotTotal = errors.New("price is the total due after quantity and discount; patch items to set the unit price")
+)
+
+// orderLines turns a request into line items. The older single item and
+// price form still works and becomes one line.
+func orderLines(req createOrderRequest) ([]lineItem, error) {
+	if len(req.Items) > 0 && (req.Item != "" || req.Price != 0) {
+		return nil, problem.FieldErrors{{Field: "items", Message: "cannot be combined with item and price"}}
+	}
+	if len(req.Items) == 0 {
+		var errs problem.FieldErrors
+		if req.Item == "" {
+			errs = append(errs, problem.FieldError{Field: "item", Message: "is required unless items is given"})
+		}
+		errs = append(errs, checkPrice("price", req.Price)...)
+		if errs != nil {
+			return nil, errs
+		}
+		return []lineItem{{Name: req.Item, UnitPrice: req.Price, Quantity: 1}}, nil
+	}
+	return checkLines(req.Items)
+}
+
+// checkPatch validates the fields a PATCH sets directly; items are checked
+// by checkLines.
+func checkPatch(req patchOrderRequest) error {
+	var errs problem.FieldErrors
+	if req.Items != nil && (req.Item != nil || req.Price != nil) {
+		errs = append(errs, problem.FieldError{Field: "items", Message: "cannot be combined with item and price"})
+	}
+	if req.Item != nil && *req.Item == "" {
+		errs = append(errs, problem.FieldError{Field: "item", Message: "must not be empty"})
+	}
+	if req.Price != nil {
+		errs = append(errs, checkPrice("price", *req.Price)...)
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func checkLines(items []lineItem) ([]lineItem, error) {
+	if len(items) == 0 {
+		return nil, problem.FieldErrors{{Field: "items", Message: "must not be empty"}}
+	}
+	if len(items) > maxLineItems {
+		return nil, problem.FieldErrors{{Field: "items", Message: fmt.Sprintf("must have at most %d entries", maxLineItems)}}
+	}
+	var errs problem.FieldErrors
+	lines := make([]lineItem, len(items))
+	for i, li := range items {
+		if li.Quantity == 0 {
+			li.Quantity = 1
+		}
+		field := fmt.Sprintf("items[%d].", i)
+		if li.Name == "" {
+			errs = append(errs, problem.FieldError{Field: field + "name", Message: "is required"})
+		}
+		errs = append(errs, checkPrice(field+"unit_price", li.UnitPrice)...)
+		if li.Quantity < 0 {
+			errs = append(errs, problem.FieldError{Field: field + "quantity", Message: "must not be negative"})
+		} else if li.Quantity > maxQuantity {
+			errs = append(errs, problem.FieldError{Field: field + "quantity", Message: fmt.Sprintf("must be at most %d", maxQuantity)})
+		}
+		lines[i] = li
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return lines, nil
+}
+
+func checkPrice(field string, price int) problem.FieldErrors {
+	switch {
+	case price <= 0:
+		return problem.FieldErrors{{Field: field, Message: "must be positive"}}
+	case price > maxUnitPrice:
+		return problem.FieldErrors{{Field: field, Message: fmt.Sprintf("must be at most %d", maxUnitPrice)}}
+	}
+	return nil
+}
+
+// newOrder prices a new order for lines.
+func newOrder(lines []lineItem, discountCode string) (order, error) {
+	ord := order{
+		Items:        lines,
+		DiscountCode: discountCode,
+		Status:       statusCreated,
+		History:      []transition{},
+		CreatedAt:    time.Now().Format(time.RFC3339),
+	}
+	return ord, ord.reprice()
+}
+
+// lines returns the order's line items. Orders stored before line items
+// existed carry their one item inline.
+func (ord *order) lines() []lineItem {
+	if len(ord.Items) == 0 && ord.Item != "" {
+		return []lineItem{{Name: ord.Item, UnitPrice: ord.Price, Quantity: 1}}
+	}
+	return ord.Items
+}
+
+// reprice recomputes the breakdown from the line items and discount code.
+// Item and Price summarize the result for listings and filters: the item
+// names and the total due.
+func (ord *order) reprice() error {
+	ord.Items = ord.lines()
+	disc, err := pricing.ParseDiscount(ord.DiscountCode)
+	if err != nil {
+		return err
+	}
+	items := make([]pricing.Item, 0, len(ord.Items))
+	names := make([]string, 0, len(ord.Items))
+	for _, li := range ord.Items {
+		items = append(items, pricing.Item{Name: li.Name, Price: li.UnitPrice * li.Quantity})
+		names = append(names, li.Name)
+	}
+	total, err := pricing.FinalTotal(items, ord.DiscountCode)
+	if err != nil {
+		return err
+	}
+	subtotal := pricing.Sum(items)
+	ord.Pricing = priceBreakdown{Subtotal: subtotal, Discount: subtotal - total, Total: total}
+	if disc.Kind != "none" {
+		ord.Pricing.DiscountKind = disc.Kind
+	}
+	ord.Item, ord.Price = strings.Join(names, ", "), total
+	return nil
+}
+
+func (ord *order) hasItem(name string) bool {
+	for _, li := range ord.Items {
+		if li.Name == name {
+			return true
+		}
+	}
+	return ord.Item == name
+}
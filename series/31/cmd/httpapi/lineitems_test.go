@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLineItemPricing(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+
+	rec := do(t, h, http.MethodPost, "/orders", `{"items":[{"name":"latte","unit_price":28,"quantity":2},{"name":"croissant","unit_price":16}],"discount_code":"OFF10"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d body=%s", rec.Code, rec.Body)
+	}
+	ord := decode[order](t, rec)
+	want := priceBreakdown{Subtotal: 72, DiscountKind: "percent", Discount: 8, Total: 64}
+	if ord.Pricing != want || ord.Price != 64 || ord.Items[1].Quantity != 1 {
+		t.Fatalf("pricing = %+v price=%d items=%+v, want %+v", ord.Pricing, ord.Price, ord.Items, want)
+	}
+
+	if rec := do(t, h, http.MethodPost, "/orders", `{"items":[{"name":"tea","unit_price":12}],"discount_code":"FREE"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("bad discount: status = %d, want 422", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPatch, "/orders/1001", `{"discount_code":"OFF95"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("patch bad discount: status = %d, want 422", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPatch, "/orders/1001", `{"price":30}`); rec.Code != http.StatusConflict {
+		t.Fatalf("patch price on several items: status = %d, want 409", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodPatch, "/orders/1001", `{"discount_code":"MINUS20"}`)
+	if got := decode[order](t, rec).Pricing; got.Total != 52 || got.DiscountKind != "minus" {
+		t.Fatalf("after patch pricing = %+v, want total 52", got)
+	}
+
+	rec = do(t, h, http.MethodGet, "/orders?item=croissant", "")
+	if page := decode[orderPage](t, rec); len(page.Orders) != 1 {
+		t.Fatalf("item filter matched %d orders, want 1", len(page.Orders))
+	}
+}
+
+func TestFailedPatchLeavesOrder(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`)
+
+	if rec := do(t, h, http.MethodPatch, "/orders/1001", `{"price":99,"discount_code":"BOGUS"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("patch: status = %d, want 422", rec.Code)
+	}
+	ord := decode[order](t, do(t, h, http.MethodGet, "/orders/1001", ""))
+	if ord.Price != 28 || ord.Items[0].UnitPrice != 28 || ord.Version != 1 {
+		t.Fatalf("after failed patch: price=%d unit_price=%d version=%d, want 28, 28, 1", ord.Price, ord.Items[0].UnitPrice, ord.Version)
+	}
+}
+
+func TestLineItemBounds(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	tests := []struct {
+		name, body string
+	}{
+		{"unit price", `{"items":[{"name":"gold","unit_price":1000000001}]}`},
+		{"quantity", `{"items":[{"name":"tea","unit_price":12,"quantity":1000001}]}`},
+		{"overflowing product", `{"items":[{"name":"tea","unit_price":9223372036854775807,"quantity":2}]}`},
+		{"single price", `{"item":"gold","price":1000000001}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(t, h, http.MethodPost, "/orders", tt.body); rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400; body=%s", rec.Code, rec.Body)
+			}
+		})
+	}
+	do(t, h, http.MethodPost, "/orders", `{"item":"tea","price":12}`)
+	if rec := do(t, h, http.MethodPatch, "/orders/1001", `{"price":1000000001}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestPatchPriceIsTotal(t *testing.T) {
+	h := buildHandler(newMemStore(), options{})
+	do(t, h, http.MethodPost, "/orders", `{"item":"latte","price":28}`)
+	do(t, h, http.MethodPost, "/orders", `{"items":[{"name":"latte","unit_price":28,"quantity":2}]}`)
+
+	rec := do(t, h, http.MethodPatch, "/orders/1001", `{"price":30}`)
+	if ord := decode[order](t, rec); rec.Code != http.StatusOK || ord.Price != 30 {
+		t.Fatalf("patch price: status = %d price=%d, want 200 and 30", rec.Code, ord.Price)
+	}
+	if rec := do(t, h, http.MethodPatch, "/orders/1001", `{"price":40,"discount_code":"OFF10"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("patch price with discount: status = %d, want 409", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPatch, "/orders/1002", `{"price":30}`); rec.Code != http.StatusConflict {
+		t.Fatalf("patch price with quantity 2: status = %d, want 409", rec.Code)
+	}
+	ord := decode[order](t, do(t, h, http.MethodGet, "/orders/1002", ""))
+	if ord.Price != 56 || ord.Items[0].UnitPrice != 28 {
+		t.Fatalf("after rejected patch: price=%d unit_price=%d, want 56 and 28", ord.Price, ord.Items[0].UnitPrice)
+	}
+}
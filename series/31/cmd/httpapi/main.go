@@ -2,159 +2,470 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"sort"
+	"os"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"learn-go/series/31/problem"
+	"learn-go/series/34/pricing"
 )
 
 type order struct {
-	ID        int    `json:"id"`
-	Item      string `json:"item"`
-	Price     int    `json:"price"`
-	CreatedAt string `json:"created_at"`
+	ID           int            `json:"id"`
+	Item         string         `json:"item"`
+	Price        int            `json:"price"`
+	Items        []lineItem     `json:"items"`
+	DiscountCode string         `json:"discount_code,omitempty"`
+	Pricing      priceBreakdown `json:"pricing"`
+	Version      int            `json:"version"`
+	Status       string         `json:"status"`
+	History      []transition   `json:"history"`
+	CreatedAt    string         `json:"created_at"`
 }
 
 type createOrderRequest struct {
-	Item  string `json:"item"`
-	Price int    `json:"price"`
+	Item         string     `json:"item,omitempty"`
+	Price        int        `json:"price,omitempty"`
+	Items        []lineItem `json:"items,omitempty"`
+	DiscountCode string     `json:"discount_code,omitempty"`
 }
 
-type store struct {
-	mu     sync.RWMutex
-	nextID int
-	items  map[int]order
+type patchOrderRequest struct {
+	Item         *string     `json:"item"`
+	Price        *int        `json:"price"`
+	Items        *[]lineItem `json:"items"`
+	DiscountCode *string     `json:"discount_code"`
 }
 
-func newStore() *store {
-	return &store{
-		nextID: 1000,
-		items:  make(map[int]order),
-	}
+var errPreconditionFailed = errors.New("order was modified by another request")
+
+type api struct {
+	store     Store
+	idem      *idempotencyStore
+	draining  *atomic.Bool
+	events    *eventHub
+	heartbeat time.Duration
+	// writes pairs each store write with its event; see commit.
+	writes sync.Mutex
 }
 
-func (s *store) create(req createOrderRequest) order {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+type options struct {
+	IdempotencyTTL time.Duration
+	// Auth, when set, requires an API key or a signed request on every
+	// route except /health and /ready.
+	Auth *authenticator
+	// Draining, when set and true, makes /ready fail.
+	Draining *atomic.Bool
+	// Events carries order changes to /orders/events; nil gets a hub of
+	// the default size.
+	Events    *eventHub
+	Heartbeat time.Duration
+}
 
-	s.nextID++
-	ord := order{
-		ID:        s.nextID,
-		Item:      req.Item,
-		Price:     req.Price,
-		CreatedAt: time.Now().Format(time.RFC3339),
+type config struct {
+	Listen    string
+	Demo      bool
+	DataDir   string
+	SnapEvery int
+	Backlog   int
+	Keyfile   string
+	AuthSkew  time.Duration
+	Options   options
+	Server    serverConfig
+}
+
+func main() {
+	cfg := parseFlags()
+	if err := run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	s.items[ord.ID] = ord
-	return ord
 }
 
-func (s *store) list() []order {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func parseFlags() config {
+	cfg := config{Server: defaultServerConfig()}
+	flag.StringVar(&cfg.Listen, "listen", "", "serve HTTP on this address, e.g. :8080")
+	flag.BoolVar(&cfg.Demo, "demo", false, "drive the handler with canned requests instead of listening (the default without -listen)")
+	flag.StringVar(&cfg.DataDir, "data", "", "directory for the order log and snapshots; empty keeps orders in memory")
+	flag.IntVar(&cfg.SnapEvery, "snapshot-every", defaultSnapEvery, "log records between snapshots")
+	flag.IntVar(&cfg.Backlog, "event-backlog", defaultEventBacklog, "recent order events kept for Last-Event-ID resume")
+	flag.DurationVar(&cfg.Options.Heartbeat, "sse-heartbeat", defaultHeartbeat, "interval between comments on idle event streams")
+	flag.DurationVar(&cfg.Options.IdempotencyTTL, "idempotency-ttl", defaultIdempotencyTTL, "how long responses are kept for Idempotency-Key replays")
+	flag.StringVar(&cfg.Keyfile, "keyfile", "", "credentials file enabling API key and HMAC auth; empty disables auth")
+	flag.DurationVar(&cfg.AuthSkew, "auth-skew", defaultAuthSkew, "largest clock difference accepted on signed requests")
+	flag.DurationVar(&cfg.Server.ReadTimeout, "read-timeout", cfg.Server.ReadTimeout, "max time to read a request, body included")
+	flag.DurationVar(&cfg.Server.ReadHeaderTimeout, "read-header-timeout", cfg.Server.ReadHeaderTimeout, "max time to read request headers")
+	flag.DurationVar(&cfg.Server.WriteTimeout, "write-timeout", cfg.Server.WriteTimeout, "max time to write a response")
+	flag.DurationVar(&cfg.Server.IdleTimeout, "idle-timeout", cfg.Server.IdleTimeout, "how long idle keep-alive connections stay open")
+	flag.IntVar(&cfg.Server.MaxHeaderBytes, "max-header-bytes", cfg.Server.MaxHeaderBytes, "max size of request headers")
+	flag.DurationVar(&cfg.Server.DrainDelay, "drain-delay", cfg.Server.DrainDelay, "how long /ready fails before the listener closes on SIGTERM")
+	flag.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "how long in-flight requests get to finish on shutdown")
+	flag.Parse()
+	return cfg
+}
 
-	result := make([]order, 0, len(s.items))
-	for _, ord := range s.items {
-		result = append(result, ord)
+func run(cfg config) error {
+	if cfg.Listen != "" && cfg.Demo {
+		return errors.New("pass at most one of -listen or -demo")
+	}
+	if cfg.Listen == "" {
+		cfg.Demo = true
+	}
+	if cfg.Keyfile != "" {
+		auth, err := loadKeyfile(cfg.Keyfile, cfg.AuthSkew)
+		if err != nil {
+			return fmt.Errorf("load keyfile: %w", err)
+		}
+		cfg.Options.Auth = auth
 	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].ID < result[j].ID
-	})
-	return result
-}
 
-func (s *store) get(id int) (order, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	var store Store = newMemStore()
+	if cfg.DataDir != "" {
+		fs, err := openFileStore(cfg.DataDir, cfg.SnapEvery)
+		if err != nil {
+			return fmt.Errorf("open store: %w", err)
+		}
+		store = fs
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "close store:", err)
+		}
+	}()
 
-	ord, ok := s.items[id]
-	return ord, ok
-}
+	if cfg.Demo {
+		demo(buildHandler(store, cfg.Options))
+		return nil
+	}
 
-type api struct {
-	store *store
+	draining := new(atomic.Bool)
+	cfg.Options.Draining = draining
+	events := newEventHub(cfg.Backlog)
+	cfg.Options.Events = events
+	cfg.Server.OnShutdown = events.close
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, ln, cfg.Server, buildHandler(store, cfg.Options), draining)
 }
 
-func main() {
-	handler := buildHandler()
-
+func demo(handler http.Handler) {
 	fmt.Println("=== net/http server demo ===")
 	simulate(handler, http.MethodGet, "/health", nil)
 	simulate(handler, http.MethodPost, "/orders", createOrderRequest{Item: "latte", Price: 28})
-	simulate(handler, http.MethodPost, "/orders", createOrderRequest{Item: "sandwich", Price: 38})
+	simulate(handler, http.MethodPost, "/orders", createOrderRequest{Item: "sandwich", Price: 38}, "Idempotency-Key", "demo-1")
+	simulate(handler, http.MethodPost, "/orders", createOrderRequest{Item: "sandwich", Price: 38}, "Idempotency-Key", "demo-1")
+	simulate(handler, http.MethodPost, "/orders", createOrderRequest{Item: "bagel", Price: 18}, "Idempotency-Key", "demo-1")
+	simulate(handler, http.MethodPost, "/orders", createOrderRequest{
+		Items:        []lineItem{{Name: "latte", UnitPrice: 28, Quantity: 2}, {Name: "croissant", UnitPrice: 16}},
+		DiscountCode: "OFF10",
+	})
+	simulate(handler, http.MethodPost, "/orders", createOrderRequest{Items: []lineItem{{Name: "tea", UnitPrice: 12}}, DiscountCode: "FREE"})
 	simulate(handler, http.MethodGet, "/orders", nil)
+	simulate(handler, http.MethodGet, "/orders?limit=1&sort=-price&min_price=20", nil)
+	simulate(handler, http.MethodGet, "/orders?sort=weight", nil)
 	simulate(handler, http.MethodGet, "/orders/1001", nil)
 	simulate(handler, http.MethodGet, "/orders/4040", nil)
-	simulate(handler, http.MethodPut, "/orders/1001", nil)
+	simulate(handler, http.MethodPut, "/orders/1001", createOrderRequest{Item: "flat white", Price: 30}, "If-Match", `"1"`)
+	simulate(handler, http.MethodPatch, "/orders/1001", map[string]int{"price": 26}, "If-Match", `"1"`)
+	simulate(handler, http.MethodDelete, "/orders/1002", nil, "If-Match", `"1"`)
+	simulate(handler, http.MethodPost, "/orders/1001", nil)
+	simulate(handler, http.MethodPost, "/orders/1001/transitions", transitionRequest{To: statusPaid, Actor: "cashier"})
+	simulate(handler, http.MethodPost, "/orders/1001/transitions", transitionRequest{To: statusDelivered, Actor: "courier"})
 }
 
-func buildHandler() http.Handler {
-	store := newStore()
-	api := &api{store: store}
+func buildHandler(store Store, opts options) http.Handler {
+	api := &api{
+		store:     store,
+		idem:      newIdempotencyStore(opts.IdempotencyTTL),
+		draining:  opts.Draining,
+		events:    opts.Events,
+		heartbeat: opts.Heartbeat,
+	}
+	if api.draining == nil {
+		api.draining = new(atomic.Bool)
+	}
+	if api.events == nil {
+		api.events = newEventHub(defaultEventBacklog)
+	}
+	if api.heartbeat <= 0 {
+		api.heartbeat = defaultHeartbeat
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", api.handleHealth)
+	mux.HandleFunc("/ready", api.handleReady)
 	mux.HandleFunc("/orders", api.handleOrders)
 	mux.HandleFunc("/orders/", api.handleOrder)
+	mux.HandleFunc("/orders/events", api.handleEvents)
+	mux.HandleFunc("/orders:import", api.handleImport)
+	mux.HandleFunc("/orders:export", api.handleExport)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, problem.CodeNotFound, "no route for "+r.URL.Path)
+	})
 
-	return chain(mux, recoverMiddleware, logMiddleware, jsonMiddleware)
+	middleware := []func(http.Handler) http.Handler{recoverMiddleware, requestIDMiddleware, logMiddleware, jsonMiddleware}
+	if opts.Auth != nil {
+		middleware = append(middleware, opts.Auth.middleware)
+	}
+	return chain(mux, middleware...)
 }
 
 func (a *api) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		writeMethodNotAllowed(w, r)
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// handleReady tells load balancers whether to send traffic. Unlike /health
+// it fails while the server drains for shutdown.
+func (a *api) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	if a.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
 func (a *api) handleOrders(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		writeJSON(w, http.StatusOK, a.store.list())
-	case http.MethodPost:
-		var req createOrderRequest
-		if err := readJSON(r, &req); err != nil {
-			writeError(w, http.StatusBadRequest, err.Error())
+		q, err := parseListQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, problem.CodeInvalidQuery, err.Error())
 			return
 		}
-		if req.Item == "" || req.Price <= 0 {
-			writeError(w, http.StatusBadRequest, "item and price are required")
+		page, err := a.store.List(q)
+		if err != nil {
+			writeStoreError(w, err)
 			return
 		}
-		ord := a.store.create(req)
-		writeJSON(w, http.StatusCreated, ord)
+		writeJSON(w, http.StatusOK, page)
+	case http.MethodPost:
+		a.idempotent(w, r, a.createOrder)
 	default:
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		writeMethodNotAllowed(w, r)
 	}
 }
 
-func (a *api) handleOrder(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+func (a *api) createOrder(w http.ResponseWriter, r *http.Request) {
+	var req createOrderRequest
+	if err := readJSON(r, &req); err != nil {
+		problem.Write(w, problem.DecodeError(err))
+		return
+	}
+	lines, err := orderLines(req)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	ord, err := newOrder(lines, req.DiscountCode)
+	if err != nil {
+		writeStoreError(w, err)
 		return
 	}
+	ord, err = a.commit(eventCreated, func() (order, error) { return a.store.Create(ord) })
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(ord))
+	writeJSON(w, http.StatusCreated, ord)
+}
 
-	idStr := strings.TrimPrefix(r.URL.Path, "/orders/")
+func (a *api) handleOrder(w http.ResponseWriter, r *http.Request) {
+	idStr, sub, nested := strings.Cut(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "invalid id")
+		writeError(w, problem.CodeInvalidID, fmt.Sprintf("%q is not an order id", idStr))
+		return
+	}
+	if nested {
+		if sub != "transitions" {
+			writeError(w, problem.CodeNotFound, "no route for "+r.URL.Path)
+			return
+		}
+		a.handleTransitions(w, r, id)
 		return
 	}
 
-	ord, ok := a.store.get(id)
-	if !ok {
-		writeError(w, http.StatusNotFound, "order not found")
+	switch r.Method {
+	case http.MethodGet:
+		ord, err := a.store.Get(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etag(ord))
+		writeJSON(w, http.StatusOK, ord)
+	case http.MethodPut:
+		var req createOrderRequest
+		if err := readJSON(r, &req); err != nil {
+			problem.Write(w, problem.DecodeError(err))
+			return
+		}
+		lines, err := orderLines(req)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		a.updateOrder(w, r, id, eventUpdated, func(ord *order) error {
+			ord.Items, ord.DiscountCode = lines, req.DiscountCode
+			return ord.reprice()
+		})
+	case http.MethodPatch:
+		var req patchOrderRequest
+		if err := readJSON(r, &req); err != nil {
+			problem.Write(w, problem.DecodeError(err))
+			return
+		}
+		if req.Item == nil && req.Price == nil && req.Items == nil && req.DiscountCode == nil {
+			writeError(w, problem.CodeBadRequest, "nothing to update")
+			return
+		}
+		if err := checkPatch(req); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		var lines []lineItem
+		if req.Items != nil {
+			var err error
+			if lines, err = checkLines(*req.Items); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		a.updateOrder(w, r, id, eventUpdated, func(ord *order) error {
+			if err := ord.reprice(); err != nil {
+				return err
+			}
+			if lines != nil {
+				ord.Items = lines
+			}
+			if req.Item != nil || req.Price != nil {
+				if len(ord.Items) != 1 {
+					return errMultipleItems
+				}
+				if req.Item != nil {
+					ord.Items[0].Name = *req.Item
+				}
+				if req.Price != nil {
+					ord.Items[0].UnitPrice = *req.Price
+				}
+			}
+			if req.DiscountCode != nil {
+				ord.DiscountCode = *req.DiscountCode
+			}
+			if err := ord.reprice(); err != nil {
+				return err
+			}
+			// Reads return price as the total due, so a written price has
+			// to come back unchanged: one unit and no discount.
+			if req.Price != nil && ord.Price != *req.Price {
+				return errPriceNotTotal
+			}
+			return nil
+		})
+	case http.MethodDelete:
+		_, err := a.commit(eventDeleted, func() (order, error) {
+			return order{ID: id}, a.store.Delete(id, ifMatch(r))
+		})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// updateOrder applies change under the request's If-Match precondition, so a
+// client holding a stale ETag gets 412 instead of overwriting a newer edit.
+// A successful change is published to event streams as event.
+func (a *api) updateOrder(w http.ResponseWriter, r *http.Request, id int, event string, change func(*order) error) {
+	check := ifMatch(r)
+	ord, err := a.commit(event, func() (order, error) {
+		return a.store.Update(id, func(ord *order) error {
+			if check != nil {
+				if err := check(*ord); err != nil {
+					return err
+				}
+			}
+			return change(ord)
+		})
+	})
+	if err != nil {
+		writeStoreError(w, err)
 		return
 	}
+	w.Header().Set("ETag", etag(ord))
 	writeJSON(w, http.StatusOK, ord)
 }
 
+// commit runs a store write and publishes event for its result before the
+// next write can start. Publishing after the store lock is released would
+// let two updates of one order reach streams out of version order.
+func (a *api) commit(event string, write func() (order, error)) (order, error) {
+	a.writes.Lock()
+	defer a.writes.Unlock()
+
+	ord, err := write()
+	if err != nil {
+		return order{}, err
+	}
+	a.events.publish(event, ord)
+	return ord, nil
+}
+
+func etag(ord order) string {
+	return `"` + strconv.Itoa(ord.Version) + `"`
+}
+
+// ifMatch returns a check for the request's If-Match header, or nil when the
+// request is unconditional.
+func ifMatch(r *http.Request) func(order) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	return func(ord order) error {
+		for _, tag := range strings.Split(header, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(ord) {
+				return nil
+			}
+		}
+		return errPreconditionFailed
+	}
+}
+
 func chain(h http.Handler, m ...func(http.Handler) http.Handler) http.Handler {
 	wrapped := h
 	for i := len(m) - 1; i >= 0; i-- {
@@ -167,18 +478,53 @@ func recoverMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				writeError(w, http.StatusInternalServerError, "internal error")
+				fmt.Fprintf(os.Stderr, "panic rid=%s: %v\n%s", w.Header().Get(problem.RequestIDHeader), rec, debug.Stack())
+				writeError(w, problem.CodeInternal, "")
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requestIDMiddleware gives each request an ID, sent back in X-Request-Id
+// and in problem responses. A client's own well-formed ID is kept so a call
+// can be traced across services.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(problem.RequestIDHeader)
+		if !validRequestID(id) {
+			var b [8]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set(problem.RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
 func logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		fmt.Printf("%s %s cost=%s\n", r.Method, r.URL.Path, time.Since(start))
+		ctx, c := withCaller(r.Context())
+		next.ServeHTTP(w, r.WithContext(ctx))
+		rid := w.Header().Get(problem.RequestIDHeader)
+		if c.Identity != "" {
+			fmt.Printf("%s %s rid=%s caller=%s cost=%s\n", r.Method, r.URL.Path, rid, c.Identity, time.Since(start))
+			return
+		}
+		fmt.Printf("%s %s rid=%s cost=%s\n", r.Method, r.URL.Path, rid, time.Since(start))
 	})
 }
 
@@ -189,10 +535,12 @@ func jsonMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+const maxJSONBytes = 1 << 20
+
 func readJSON(r *http.Request, dst any) error {
 	defer r.Body.Close()
 
-	limited := io.LimitReader(r.Body, 1<<20)
+	limited := io.LimitReader(r.Body, maxJSONBytes)
 	dec := json.NewDecoder(limited)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(dst); err != nil {
@@ -204,6 +552,24 @@ func readJSON(r *http.Request, dst any) error {
 	return nil
 }
 
+// bufferBody reads the body for middleware that must see it before the
+// handler does, and puts it back. A body over limit is refused rather than
+// cut short, so nothing downstream sees part of a request as the whole.
+func bufferBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, *problem.Problem) {
+	rc := http.MaxBytesReader(w, r.Body, limit)
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, problem.New(problem.CodePayloadTooLarge, fmt.Sprintf("body exceeds %d bytes", tooLarge.Limit))
+	case err != nil:
+		return nil, problem.New(problem.CodeBadRequest, "read body: "+err.Error())
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
@@ -211,11 +577,46 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = enc.Encode(v)
 }
 
-func writeError(w http.ResponseWriter, status int, msg string) {
-	writeJSON(w, status, map[string]string{"error": msg})
+func writeError(w http.ResponseWriter, code problem.Code, detail string) {
+	problem.Write(w, problem.New(code, detail))
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, problem.CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
+
+// writeStoreError maps errors from validation, pricing and the store to
+// their problem codes. Anything unrecognized is an internal error; its text
+// goes to stderr under the request ID instead of to the client.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var (
+		terr   *transitionError
+		fields problem.FieldErrors
+		prob   *problem.Problem
+	)
+	switch {
+	case errors.As(err, &prob):
+		problem.Write(w, prob)
+	case errors.As(err, &fields):
+		problem.Write(w, problem.Invalid(fields))
+	case errors.As(err, &terr):
+		problem.Write(w, problem.New(problem.CodeInvalidTransition, terr.Error()).With("allowed", terr.Allowed))
+	case errors.Is(err, errNotFound):
+		writeError(w, problem.CodeNotFound, err.Error())
+	case errors.Is(err, errPreconditionFailed):
+		writeError(w, problem.CodePreconditionFailed, err.Error())
+	case errors.Is(err, pricing.ErrInvalidDiscount):
+		writeError(w, problem.CodeInvalidDiscount, err.Error())
+	case errors.Is(err, errMultipleItems), errors.Is(err, errPriceNotTotal):
+		writeError(w, problem.CodeConflict, err.Error())
+	default:
+		fmt.Fprintf(os.Stderr, "internal error rid=%s: %v\n", w.Header().Get(problem.RequestIDHeader), err)
+		writeError(w, problem.CodeInternal, "")
+	}
 }
 
-func simulate(handler http.Handler, method, path string, payload any) {
+// simulate sends one request; headers are given as name, value pairs.
+func simulate(handler http.Handler, method, path string, payload any, headers ...string) {
 	var body io.Reader
 	if payload != nil {
 		data, _ := json.Marshal(payload)
@@ -225,6 +626,9 @@ func simulate(handler http.Handler, method, path string, payload any) {
 	if payload != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
 	rec := httptest.NewRecorder()
 
 	handler.ServeHTTP(rec, req)
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var sortFields = map[string]bool{"id": true, "price": true, "created_at": true}
+
+// listQuery selects one page of orders. Zero values mean "no filter", and a
+// zero Limit returns every match in one page.
+type listQuery struct {
+	Limit        int
+	Cursor       *cursor
+	Item         string
+	MinPrice     int
+	MaxPrice     int
+	CreatedAfter time.Time
+	Sort         string
+}
+
+type orderPage struct {
+	Orders     []order `json:"orders"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+// cursor is the position after the last order of a page. It is handed out
+// as opaque base64 and only valid for the sort it was made with.
+type cursor struct {
+	Sort      string `json:"s"`
+	ID        int    `json:"id"`
+	Price     int    `json:"p,omitempty"`
+	CreatedAt string `json:"c,omitempty"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func parseListQuery(v url.Values) (listQuery, error) {
+	q := listQuery{Limit: defaultPageSize, Item: v.Get("item"), Sort: "id"}
+
+	if raw := v.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return listQuery{}, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = n
+	}
+	if raw := v.Get("sort"); raw != "" {
+		field := raw
+		if field[0] == '-' {
+			field = field[1:]
+		}
+		if !sortFields[field] {
+			return listQuery{}, errors.New("sort must be one of id, price, created_at, optionally prefixed with -")
+		}
+		q.Sort = raw
+	}
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"min_price", &q.MinPrice}, {"max_price", &q.MaxPrice}} {
+		if raw := v.Get(p.name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return listQuery{}, fmt.Errorf("%s must be a non-negative integer", p.name)
+			}
+			*p.dst = n
+		}
+	}
+	if q.MaxPrice > 0 && q.MinPrice > q.MaxPrice {
+		return listQuery{}, errors.New("min_price must not exceed max_price")
+	}
+	if raw := v.Get("created_after"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return listQuery{}, errors.New("created_after must be an RFC 3339 timestamp")
+		}
+		q.CreatedAfter = t
+	}
+	if raw := v.Get("cursor"); raw != "" {
+		c, err := decodeCursor(raw)
+		if err != nil || c.Sort != q.Sort {
+			return listQuery{}, errInvalidCursor
+		}
+		q.Cursor = &c
+	}
+	return q, nil
+}
+
+func decodeCursor(raw string) (cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor{}, err
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return cursor{}, err
+	}
+	return c, nil
+}
+
+func encodeCursor(sortBy string, ord order) string {
+	data, _ := json.Marshal(cursor{Sort: sortBy, ID: ord.ID, Price: ord.Price, CreatedAt: ord.CreatedAt})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (q listQuery) match(ord order) bool {
+	if q.Item != "" && !ord.hasItem(q.Item) {
+		return false
+	}
+	if ord.Price < q.MinPrice || (q.MaxPrice > 0 && ord.Price > q.MaxPrice) {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !createdAt(ord).After(q.CreatedAfter) {
+		return false
+	}
+	return true
+}
+
+// before orders by the sort field, then by ID in the same direction, so every
+// order has exactly one position and a cursor never skips or repeats one.
+func (q listQuery) before(a, b order) bool {
+	field, desc := q.Sort, false
+	if field != "" && field[0] == '-' {
+		field, desc = field[1:], true
+	}
+	cmp := 0
+	switch field {
+	case "price":
+		cmp = a.Price - b.Price
+	case "created_at":
+		cmp = createdAt(a).Compare(createdAt(b))
+	}
+	if cmp == 0 {
+		cmp = a.ID - b.ID
+	}
+	if desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func createdAt(ord order) time.Time {
+	t, _ := time.Parse(time.RFC3339, ord.CreatedAt)
+	return t
+}
+
+func (t *orderTable) query(q listQuery) orderPage {
+	// With a limit only the first Limit+1 matches are kept, so paging
+	// through a large table does not copy all of it on every page.
+	keep := &pageHeap{q: q}
+	var after order
+	if q.Cursor != nil {
+		after = order{ID: q.Cursor.ID, Price: q.Cursor.Price, CreatedAt: q.Cursor.CreatedAt}
+	}
+	for _, ord := range t.items {
+		if !q.match(ord) || (q.Cursor != nil && !q.before(after, ord)) {
+			continue
+		}
+		if q.Limit <= 0 || keep.Len() <= q.Limit {
+			heap.Push(keep, ord)
+		} else if q.before(ord, keep.orders[0]) {
+			keep.orders[0] = ord
+			heap.Fix(keep, 0)
+		}
+	}
+	matched := keep.orders
+	if matched == nil {
+		matched = make([]order, 0)
+	}
+	sort.Slice(matched, func(i, j int) bool { return q.before(matched[i], matched[j]) })
+
+	page := orderPage{Orders: matched}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		page.Orders = matched[:q.Limit]
+		page.NextCursor = encodeCursor(q.Sort, page.Orders[q.Limit-1])
+	}
+	return page
+}
+
+// pageHeap is a max-heap in list order: the root is the match that would
+// come last, and the first to go when a better one turns up.
+type pageHeap struct {
+	q      listQuery
+	orders []order
+}
+
+func (h *pageHeap) Len() int           { return len(h.orders) }
+func (h *pageHeap) Less(i, j int) bool { return h.q.before(h.orders[j], h.orders[i]) }
+func (h *pageHeap) Swap(i, j int)      { h.orders[i], h.orders[j] = h.orders[j], h.orders[i] }
+func (h *pageHeap) Push(x any)         { h.orders = append(h.orders, x.(order)) }
+func (h *pageHeap) Pop() any {
+	last := h.orders[len(h.orders)-1]
+	h.orders = h.orders[:len(h.orders)-1]
+	return last
+}
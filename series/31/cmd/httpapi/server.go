@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type serverConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// DrainDelay is how long /ready reports draining before the listener
+	// closes, so load balancers stop routing here first.
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
+	// OnShutdown runs as shutdown starts, to end long-lived responses such
+	// as event streams that Shutdown would otherwise wait out.
+	OnShutdown func()
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+		DrainDelay:        5 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+	}
+}
+
+// serve runs handler on ln until ctx is canceled, then drains: readiness
+// fails first, and after DrainDelay the server stops accepting and waits up
+// to ShutdownTimeout for in-flight requests.
+func serve(ctx context.Context, ln net.Listener, cfg serverConfig, handler http.Handler, draining *atomic.Bool) error {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.OnShutdown != nil {
+		srv.RegisterOnShutdown(cfg.OnShutdown)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	fmt.Printf("listening on %s\n", ln.Addr())
+
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	draining.Store(true)
+	fmt.Printf("draining: readiness failing for %s\n", cfg.DrainDelay)
+	select {
+	case <-time.After(cfg.DrainDelay):
+	case err := <-errc:
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve: %w", err)
+	}
+	fmt.Println("shutdown complete")
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + ln.Addr().String()
+
+	draining := new(atomic.Bool)
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/", buildHandler(newMemStore(), options{Draining: draining}))
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(400 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+
+	cfg := defaultServerConfig()
+	cfg.DrainDelay, cfg.ShutdownTimeout = 200*time.Millisecond, 5*time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, ln, cfg, mux, draining) }()
+
+	if resp, err := http.Get(base + "/ready"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("ready before drain: %v %v", resp, err)
+	}
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+	cancel()
+
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get(base + "/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("ready during drain = %d, want 503", resp.StatusCode)
+	}
+
+	if got := <-slow; got != "done" {
+		t.Fatalf("in-flight request got %q, want it to finish", got)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, err := http.Get(base + "/ready"); err == nil {
+		t.Fatal("server still accepting after shutdown")
+	}
+}
+
+func TestRunRejectsListenWithDemo(t *testing.T) {
+	err := run(config{Listen: "127.0.0.1:0", Demo: true, Server: defaultServerConfig()})
+	if err == nil {
+		t.Fatal("run accepted both -listen and -demo")
+	}
+}
+
+func TestRecoverLogsPanic(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	h := chain(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	}), recoverMiddleware, requestIDMiddleware)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "req-42")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	os.Stderr = stderr
+	w.Close()
+	logged, _ := io.ReadAll(r)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	for _, want := range []string{"panic rid=req-42: boom", "server_test.go"} {
+		if !strings.Contains(string(logged), want) {
+			t.Fatalf("stderr missing %q:\n%s", want, logged)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+)
+
+var errNotFound = errors.New("order not found")
+
+// Store keeps orders. Create assigns the ID and version 1; IDs are never
+// handed out twice, even after the order is deleted.
+type Store interface {
+	Create(ord order) (order, error)
+	Get(id int) (order, error)
+	List(q listQuery) (orderPage, error)
+	// Update applies fn to a copy of the order and stores the result with
+	// the next version unless fn returns an error.
+	Update(id int, fn func(*order) error) (order, error)
+	// Delete removes the order unless check, when given, returns an error.
+	Delete(id int, check func(order) error) error
+	Close() error
+}
+
+const firstOrderID = 1000
+
+// orderTable is the state both stores share. It does no locking.
+type orderTable struct {
+	nextID int
+	items  map[int]order
+}
+
+func newOrderTable() orderTable {
+	return orderTable{nextID: firstOrderID, items: make(map[int]order)}
+}
+
+func (t *orderTable) put(ord order) {
+	t.items[ord.ID] = ord
+	if ord.ID > t.nextID {
+		t.nextID = ord.ID
+	}
+}
+
+func (t *orderTable) list() []order {
+	result := make([]order, 0, len(t.items))
+	for _, ord := range t.items {
+		result = append(result, ord)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (t *orderTable) updated(id int, fn func(*order) error) (order, error) {
+	ord, ok := t.items[id]
+	if !ok {
+		return order{}, errNotFound
+	}
+	version := ord.Version
+	// The copy must not share slices with the stored order, or a change that
+	// fails halfway would still show through.
+	ord.Items, ord.History = slices.Clone(ord.Items), slices.Clone(ord.History)
+	if err := fn(&ord); err != nil {
+		return order{}, err
+	}
+	ord.ID, ord.Version = id, version+1
+	return ord, nil
+}
+
+func (t *orderTable) deletable(id int, check func(order) error) error {
+	ord, ok := t.items[id]
+	if !ok {
+		return errNotFound
+	}
+	if check != nil {
+		return check(ord)
+	}
+	return nil
+}
+
+type memStore struct {
+	mu    sync.RWMutex
+	table orderTable
+}
+
+func newMemStore() *memStore {
+	return &memStore{table: newOrderTable()}
+}
+
+func (s *memStore) Create(ord order) (order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ord.ID, ord.Version = s.table.nextID+1, 1
+	s.table.put(ord)
+	return ord, nil
+}
+
+func (s *memStore) Get(id int) (order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ord, ok := s.table.items[id]
+	if !ok {
+		return order{}, errNotFound
+	}
+	return ord, nil
+}
+
+func (s *memStore) List(q listQuery) (orderPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.table.query(q), nil
+}
+
+func (s *memStore) Update(id int, fn func(*order) error) (order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ord, err := s.table.updated(id, fn)
+	if err != nil {
+		return order{}, err
+	}
+	s.table.put(ord)
+	return ord, nil
+}
+
+func (s *memStore) Delete(id int, check func(order) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.table.deletable(id, check); err != nil {
+		return err
+	}
+	delete(s.table.items, id)
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
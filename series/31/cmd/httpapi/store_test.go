@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	a, err := s.Create(order{Item: "latte", Price: 28})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.Create(order{Item: "tea", Price: 12})
+	if a.ID != firstOrderID+1 || b.ID != a.ID+1 {
+		t.Fatalf("ids = %d, %d", a.ID, b.ID)
+	}
+
+	got, err := s.Update(a.ID, func(o *order) error {
+		o.Price = 30
+		return nil
+	})
+	if err != nil || got.Price != 30 {
+		t.Fatalf("update = %+v, %v", got, err)
+	}
+	refuse := errors.New("refused")
+	if _, err := s.Update(a.ID, func(o *order) error { o.Price = 1; return refuse }); !errors.Is(err, refuse) {
+		t.Fatalf("update err = %v, want refused", err)
+	}
+	if got, _ := s.Get(a.ID); got.Price != 30 {
+		t.Fatalf("failed update leaked: price = %d", got.Price)
+	}
+
+	if err := s.Delete(b.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(b.ID); !errors.Is(err, errNotFound) {
+		t.Fatalf("get deleted = %v, want errNotFound", err)
+	}
+	if err := s.Delete(b.ID, nil); !errors.Is(err, errNotFound) {
+		t.Fatalf("delete twice = %v, want errNotFound", err)
+	}
+	if page, _ := s.List(listQuery{}); len(page.Orders) != 1 || page.Orders[0].ID != a.ID {
+		t.Fatalf("list = %+v", page.Orders)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, newMemStore())
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := openFileStore(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openFileStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"a", "b", "c"} {
+		if _, err := s.Create(order{Item: item, Price: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(firstOrderID+3, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash: no Close, so the last records live only in the log.
+	s.log.Close()
+
+	s, err = openFileStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if page, _ := s.List(listQuery{}); len(page.Orders) != 2 {
+		t.Fatalf("recovered %d orders, want 2", len(page.Orders))
+	}
+	ord, err := s.Create(order{Item: "d", Price: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ord.ID != firstOrderID+4 {
+		t.Fatalf("id after restart = %d, want %d; deleted ids must not be reused", ord.ID, firstOrderID+4)
+	}
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openFileStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(order{Item: "a", Price: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s.log.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","order":{"id":10`)
+	f.Close()
+
+	s, err = openFileStore(dir, 100)
+	if err != nil {
+		t.Fatalf("reopen with torn tail: %v", err)
+	}
+	defer s.Close()
+	if page, _ := s.List(listQuery{}); len(page.Orders) != 1 {
+		t.Fatalf("recovered %d orders, want 1", len(page.Orders))
+	}
+	if ord, _ := s.Create(order{Item: "b", Price: 1}); ord.ID != firstOrderID+2 {
+		t.Fatalf("id = %d, want %d", ord.ID, firstOrderID+2)
+	}
+}
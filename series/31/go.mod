@@ -1,3 +1,7 @@
 module learn-go/series/31
 
 go 1.22
+
+require learn-go/series/34 v0.0.0
+
+replace learn-go/series/34 => ../34
@@ -0,0 +1,218 @@
+// Package problem writes RFC 7807 problem details. Every problem carries a
+// code from a fixed catalog, so clients can branch on it instead of on
+// wording that may change.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	ContentType     = "application/problem+json"
+	RequestIDHeader = "X-Request-Id"
+	// TypeBase prefixes the code to form the type URI.
+	TypeBase = "/problems/"
+)
+
+type Code string
+
+const (
+	CodeBadRequest            Code = "bad_request"
+	CodeInvalidJSON           Code = "invalid_json"
+	CodeValidation            Code = "validation_failed"
+	CodeInvalidID             Code = "invalid_id"
+	CodeInvalidQuery          Code = "invalid_query"
+	CodeUnauthorized          Code = "unauthorized"
+	CodeNotFound              Code = "not_found"
+	CodeMethodNotAllowed      Code = "method_not_allowed"
+	CodeRequestTimeout        Code = "request_timeout"
+	CodeConflict              Code = "conflict"
+	CodeInvalidTransition     Code = "invalid_transition"
+	CodeIdempotencyInProgress Code = "idempotency_in_progress"
+	CodePreconditionFailed    Code = "precondition_failed"
+	CodePayloadTooLarge       Code = "payload_too_large"
+	CodeUnsupportedMediaType  Code = "unsupported_media_type"
+	CodeInvalidDiscount       Code = "invalid_discount"
+	CodeIdempotencyKeyReused  Code = "idempotency_key_reused"
+	CodeImportRejected        Code = "import_rejected"
+	CodeInternal              Code = "internal_error"
+	CodeUnavailable           Code = "service_unavailable"
+	CodeGatewayTimeout        Code = "gateway_timeout"
+)
+
+type entry struct {
+	status int
+	title  string
+}
+
+// catalog fixes each code's status and title. Codes and titles are part of
+// the API: add new ones rather than changing these.
+var catalog = map[Code]entry{
+	CodeBadRequest:            {http.StatusBadRequest, "Bad request"},
+	CodeInvalidJSON:           {http.StatusBadRequest, "Malformed JSON body"},
+	CodeValidation:            {http.StatusBadRequest, "Request failed validation"},
+	CodeInvalidID:             {http.StatusBadRequest, "Invalid resource ID"},
+	CodeInvalidQuery:          {http.StatusBadRequest, "Invalid query parameter"},
+	CodeUnauthorized:          {http.StatusUnauthorized, "Authentication required"},
+	CodeNotFound:              {http.StatusNotFound, "Resource not found"},
+	CodeMethodNotAllowed:      {http.StatusMethodNotAllowed, "Method not allowed"},
+	CodeRequestTimeout:        {http.StatusRequestTimeout, "Request canceled"},
+	CodeConflict:              {http.StatusConflict, "Conflicting request"},
+	CodeInvalidTransition:     {http.StatusConflict, "Status change not allowed"},
+	CodeIdempotencyInProgress: {http.StatusConflict, "Idempotent request still in progress"},
+	CodePreconditionFailed:    {http.StatusPreconditionFailed, "Precondition failed"},
+	CodePayloadTooLarge:       {http.StatusRequestEntityTooLarge, "Request body too large"},
+	CodeUnsupportedMediaType:  {http.StatusUnsupportedMediaType, "Unsupported media type"},
+	CodeInvalidDiscount:       {http.StatusUnprocessableEntity, "Invalid discount code"},
+	CodeIdempotencyKeyReused:  {http.StatusUnprocessableEntity, "Idempotency key reused"},
+	CodeImportRejected:        {http.StatusUnprocessableEntity, "Import rejected"},
+	CodeInternal:              {http.StatusInternalServerError, "Internal server error"},
+	CodeUnavailable:           {http.StatusServiceUnavailable, "Service unavailable"},
+	CodeGatewayTimeout:        {http.StatusGatewayTimeout, "Request timed out"},
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is a validation failure on one or more request fields.
+type FieldErrors []FieldError
+
+func (fe FieldErrors) Error() string {
+	parts := make([]string, len(fe))
+	for i, e := range fe {
+		parts[i] = e.Field + " " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      Code         `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// Extensions are extra top-level members, such as the statuses a
+	// conflicting transition could have moved to.
+	Extensions map[string]any `json:"-"`
+}
+
+// New returns the problem for code. A code missing from the catalog is
+// reported as an internal error so a typo cannot produce a 200.
+func New(code Code, detail string) *Problem {
+	e, ok := catalog[code]
+	if !ok {
+		code, e = CodeInternal, catalog[CodeInternal]
+	}
+	return &Problem{Type: TypeBase + string(code), Title: e.title, Status: e.status, Detail: detail, Code: code}
+}
+
+// Invalid reports a payload whose fields failed validation.
+func Invalid(errs FieldErrors) *Problem {
+	p := New(CodeValidation, "one or more fields are invalid")
+	p.Errors = errs
+	return p
+}
+
+// With adds an extension member and returns p.
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]any)
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return string(p.Code)
+	}
+	return string(p.Code) + ": " + p.Detail
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	type plain Problem
+	data, err := json.Marshal((*plain)(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+	ext, err := json.Marshal(p.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(data[:len(data)-1], ','), ext[1:]...), nil
+}
+
+// Write sends p. The request ID is taken from the response's X-Request-Id
+// header when p does not already carry one.
+func Write(w http.ResponseWriter, p *Problem) {
+	out := *p
+	if out.RequestID == "" {
+		out.RequestID = w.Header().Get(RequestIDHeader)
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(out.Status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(&out)
+}
+
+// DecodeError turns an error from decoding a JSON body into a problem.
+// Wrong types and unknown fields become field errors; anything else is
+// malformed JSON.
+func DecodeError(err error) *Problem {
+	var (
+		typeErr   *json.UnmarshalTypeError
+		syntaxErr *json.SyntaxError
+		tooLarge  *http.MaxBytesError
+	)
+	switch {
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "(body)"
+		}
+		return Invalid(FieldErrors{{Field: field, Message: "must be " + describe(typeErr.Type)}})
+	case errors.As(err, &syntaxErr):
+		return New(CodeInvalidJSON, fmt.Sprintf("syntax error at byte %d", syntaxErr.Offset))
+	case errors.As(err, &tooLarge):
+		return New(CodePayloadTooLarge, fmt.Sprintf("body exceeds %d bytes", tooLarge.Limit))
+	case errors.Is(err, io.EOF):
+		return New(CodeInvalidJSON, "body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return New(CodeInvalidJSON, "body ends before the JSON value does")
+	}
+	// encoding/json reports unknown fields only as text.
+	if _, after, ok := strings.Cut(err.Error(), `json: unknown field "`); ok {
+		return Invalid(FieldErrors{{Field: strings.TrimSuffix(after, `"`), Message: "is not a known field"}})
+	}
+	return New(CodeInvalidJSON, err.Error())
+}
+
+func describe(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Pointer:
+		return describe(t.Elem())
+	}
+	return "an object"
+}
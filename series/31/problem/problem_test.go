@@ -0,0 +1,89 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	for code, e := range catalog {
+		if e.status < 400 || e.status > 599 || e.title == "" {
+			t.Errorf("%s: status %d title %q", code, e.status, e.title)
+		}
+	}
+	if p := New("no_such_code", "x"); p.Code != CodeInternal || p.Status != http.StatusInternalServerError {
+		t.Fatalf("unknown code = %+v, want internal error", p)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set(RequestIDHeader, "req-7")
+	Write(rec, New(CodeInvalidTransition, "order is delivered").With("allowed", []string{"refunded"}))
+
+	if rec.Code != http.StatusConflict || rec.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("status = %d content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"type":       "/problems/invalid_transition",
+		"title":      "Status change not allowed",
+		"status":     float64(409),
+		"detail":     "order is delivered",
+		"code":       "invalid_transition",
+		"request_id": "req-7",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if allowed, _ := got["allowed"].([]any); len(allowed) != 1 || allowed[0] != "refunded" {
+		t.Errorf("allowed = %v", got["allowed"])
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	type body struct {
+		Price int `json:"price"`
+	}
+	decode := func(s string) error {
+		var b body
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.DisallowUnknownFields()
+		return dec.Decode(&b)
+	}
+	tests := []struct {
+		name  string
+		in    string
+		code  Code
+		field string
+	}{
+		{name: "wrong type", in: `{"price":"ten"}`, code: CodeValidation, field: "price"},
+		{name: "unknown field", in: `{"cost":1}`, code: CodeValidation, field: "cost"},
+		{name: "syntax", in: `{"price":}`, code: CodeInvalidJSON},
+		{name: "empty", in: ``, code: CodeInvalidJSON},
+		{name: "truncated", in: `{"price":1`, code: CodeInvalidJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := DecodeError(decode(tt.in))
+			if p.Code != tt.code {
+				t.Fatalf("code = %s (%s), want %s", p.Code, p.Detail, tt.code)
+			}
+			if tt.field != "" && (len(p.Errors) != 1 || p.Errors[0].Field != tt.field) {
+				t.Fatalf("errors = %+v, want field %s", p.Errors, tt.field)
+			}
+		})
+	}
+	fe := FieldErrors{{Field: "to", Message: "is required"}, {Field: "actor", Message: "is required"}}
+	if got := fe.Error(); got != "to is required; actor is required" {
+		t.Fatalf("FieldErrors.Error = %q", got)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"learn-go/series/31/problem"
 )
 
 type ctxKey string
@@ -44,16 +46,16 @@ func buildHandler(timeout time.Duration) http.Handler {
 func handleWork(delay time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			writeError(w, problem.CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
 			return
 		}
 
 		if err := work(r.Context(), delay); err != nil {
-			status := http.StatusGatewayTimeout
+			code := problem.CodeGatewayTimeout
 			if errors.Is(err, context.Canceled) {
-				status = http.StatusRequestTimeout
+				code = problem.CodeRequestTimeout
 			}
-			writeError(w, status, err.Error())
+			writeError(w, code, err.Error())
 			return
 		}
 
@@ -86,7 +88,7 @@ func recoverMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				writeError(w, http.StatusInternalServerError, "internal error")
+				writeError(w, problem.CodeInternal, "")
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -98,6 +100,7 @@ func requestIDMiddleware(next http.Handler) http.Handler {
 		id := atomic.AddInt64(&reqSeq, 1)
 		reqID := fmt.Sprintf("req-%04d", id)
 		ctx := context.WithValue(r.Context(), requestIDKey, reqID)
+		w.Header().Set(problem.RequestIDHeader, reqID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -143,8 +146,8 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = enc.Encode(v)
 }
 
-func writeError(w http.ResponseWriter, status int, msg string) {
-	writeJSON(w, status, map[string]string{"error": msg})
+func writeError(w http.ResponseWriter, code problem.Code, detail string) {
+	problem.Write(w, problem.New(code, detail))
 }
 
 func simulate(handler http.Handler, label, path string, clientTimeout time.Duration) {
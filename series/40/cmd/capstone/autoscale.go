@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+type AutoscalePolicy struct {
+	MinWorkers int
+	MaxWorkers int
+	Interval   time.Duration
+	Backlog    int
+	MaxWait    time.Duration
+	IdleAfter  time.Duration
+}
+
+type scaleInput struct {
+	workers    int
+	busy       int
+	queued     int
+	oldestWait time.Duration
+}
+
+type autoscaler struct {
+	policy    AutoscalePolicy
+	clock     Clock
+	idleSince time.Time
+}
+
+func defaultAutoscalePolicy() AutoscalePolicy {
+	return AutoscalePolicy{
+		Interval:  50 * time.Millisecond,
+		Backlog:   2,
+		MaxWait:   200 * time.Millisecond,
+		IdleAfter: 300 * time.Millisecond,
+	}
+}
+
+func (p AutoscalePolicy) enabled() bool {
+	return p.MaxWorkers > 0
+}
+
+func (p AutoscalePolicy) validate(workers int) error {
+	if !p.enabled() {
+		return nil
+	}
+	if p.MinWorkers <= 0 {
+		return errors.New("min-workers must be positive")
+	}
+	if p.MaxWorkers < p.MinWorkers {
+		return errors.New("max-workers must not be below min-workers")
+	}
+	if workers < p.MinWorkers || workers > p.MaxWorkers {
+		return errors.New("workers must be within min-workers and max-workers")
+	}
+	if p.Interval <= 0 || p.Backlog <= 0 || p.MaxWait <= 0 || p.IdleAfter <= 0 {
+		return errors.New("autoscale thresholds must be positive")
+	}
+	return nil
+}
+
+func newAutoscaler(policy AutoscalePolicy, clock Clock) *autoscaler {
+	return &autoscaler{policy: policy, clock: clock}
+}
+
+// observe returns +1 to add a worker, -1 to retire one, or 0, plus the reason.
+// Scale-up reacts on the first sample; scale-down waits until some worker has
+// been idle with an empty queue for IdleAfter, and then retires one at a time.
+func (a *autoscaler) observe(in scaleInput) (int, string) {
+	now := a.clock.Now()
+
+	if in.queued > 0 {
+		a.idleSince = time.Time{}
+		if in.workers >= a.policy.MaxWorkers {
+			return 0, ""
+		}
+		if in.queued > in.workers*a.policy.Backlog {
+			return 1, "backlog"
+		}
+		if in.oldestWait > a.policy.MaxWait {
+			return 1, "wait"
+		}
+		return 0, ""
+	}
+
+	if in.busy >= in.workers || in.workers <= a.policy.MinWorkers {
+		a.idleSince = time.Time{}
+		return 0, ""
+	}
+	if a.idleSince.IsZero() {
+		a.idleSince = now
+		return 0, ""
+	}
+	if now.Sub(a.idleSince) < a.policy.IdleAfter {
+		return 0, ""
+	}
+	a.idleSince = now
+	return -1, "idle"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(time.Duration) Ticker {
+	return fakeTicker{}
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.Advance(d)
+	return ctx.Err()
+}
+
+func (c *fakeClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithCancel(parent)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type fakeTicker struct{}
+
+func (fakeTicker) C() <-chan time.Time { return nil }
+
+func (fakeTicker) Stop() {}
+
+func testPolicy() AutoscalePolicy {
+	p := defaultAutoscalePolicy()
+	p.MinWorkers = 1
+	p.MaxWorkers = 4
+	return p
+}
+
+func TestAutoscalerScaleUp(t *testing.T) {
+	cases := []struct {
+		name  string
+		in    scaleInput
+		delta int
+	}{
+		{name: "backlog", in: scaleInput{workers: 2, busy: 2, queued: 5}, delta: 1},
+		{name: "wait", in: scaleInput{workers: 2, busy: 2, queued: 1, oldestWait: time.Second}, delta: 1},
+		{name: "at max", in: scaleInput{workers: 4, busy: 4, queued: 50, oldestWait: time.Second}, delta: 0},
+		{name: "keeping up", in: scaleInput{workers: 2, busy: 2, queued: 1}, delta: 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newAutoscaler(testPolicy(), &fakeClock{now: time.Unix(0, 0)})
+			delta, _ := a.observe(tc.in)
+			if delta != tc.delta {
+				t.Fatalf("delta = %d, want %d", delta, tc.delta)
+			}
+		})
+	}
+}
+
+func TestAutoscalerRetiresIdleWorkers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	policy := testPolicy()
+	a := newAutoscaler(policy, clock)
+	idle := scaleInput{workers: 3, busy: 1}
+
+	if delta, _ := a.observe(idle); delta != 0 {
+		t.Fatalf("first idle sample delta = %d, want 0", delta)
+	}
+	clock.Advance(policy.IdleAfter / 2)
+	if delta, _ := a.observe(idle); delta != 0 {
+		t.Fatalf("delta before IdleAfter = %d, want 0", delta)
+	}
+	clock.Advance(policy.IdleAfter / 2)
+	if delta, _ := a.observe(idle); delta != -1 {
+		t.Fatalf("delta after IdleAfter = %d, want -1", delta)
+	}
+	if delta, _ := a.observe(idle); delta != 0 {
+		t.Fatalf("delta right after retiring = %d, want 0", delta)
+	}
+}
+
+func TestAutoscalerKeepsMinWorkers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	policy := testPolicy()
+	a := newAutoscaler(policy, clock)
+	idle := scaleInput{workers: policy.MinWorkers}
+
+	for i := 0; i < 5; i++ {
+		if delta, _ := a.observe(idle); delta != 0 {
+			t.Fatalf("delta at min workers = %d, want 0", delta)
+		}
+		clock.Advance(policy.IdleAfter)
+	}
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	msgHello     = "hello"
+	msgLease     = "lease"
+	msgJob       = "job"
+	msgHeartbeat = "heartbeat"
+	msgResult    = "result"
+	msgDone      = "done"
+)
+
+const (
+	defaultClusterAddr = "127.0.0.1:7070"
+	peerWriteTimeout   = 5 * time.Second
+)
+
+var errLeaseLost = errors.New("lease lost")
+
+// clusterMsg is one JSON line on a coordinator/worker connection. Workers
+// send hello, lease, heartbeat and result; the coordinator answers a lease
+// request with job once one is ready, or done when the run is over.
+type clusterMsg struct {
+	Type        string          `json:"type"`
+	Worker      string          `json:"worker,omitempty"`
+	Lease       int             `json:"lease,omitempty"`
+	Job         int             `json:"job,omitempty"`
+	Kind        string          `json:"kind,omitempty"`
+	Priority    int             `json:"priority,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Heartbeat   time.Duration   `json:"heartbeat,omitempty"`
+	MaxAttempts int             `json:"max_attempts,omitempty"`
+	Backoff     time.Duration   `json:"backoff,omitempty"`
+	MaxBackoff  time.Duration   `json:"max_backoff,omitempty"`
+	Attempts    int             `json:"attempts,omitempty"`
+	Err         string          `json:"err,omitempty"`
+	ErrKind     string          `json:"err_kind,omitempty"`
+}
+
+// Error kinds carry what errors.Is would have matched on the worker, since
+// only the error text crosses the wire.
+const (
+	errKindCanceled  = "canceled"
+	errKindDeadline  = "deadline"
+	errKindFatal     = "fatal"
+	errKindRetryable = "retryable"
+)
+
+func errKindOf(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errKindCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return errKindDeadline
+	case errors.Is(err, errJobFatal):
+		return errKindFatal
+	}
+	return errKindRetryable
+}
+
+// remoteError is a worker's error rebuilt on the coordinator around the
+// sentinel its kind names.
+type remoteError struct {
+	msg  string
+	kind error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+
+func (e *remoteError) Unwrap() error { return e.kind }
+
+func remoteErr(msg, kind string) error {
+	var sentinel error
+	switch kind {
+	case errKindCanceled:
+		sentinel = context.Canceled
+	case errKindDeadline:
+		sentinel = context.DeadlineExceeded
+	case errKindFatal:
+		sentinel = errJobFatal
+	}
+	return &remoteError{msg: msg, kind: sentinel}
+}
+
+type peer struct {
+	id   int
+	name string
+	conn net.Conn
+	enc  *json.Encoder
+}
+
+type peerEvent struct {
+	peer *peer
+	msg  clusterMsg
+	err  error
+}
+
+type lease struct {
+	id       int
+	job      job
+	peer     *peer
+	start    time.Time
+	deadline time.Time
+}
+
+func coordinatorMain(args []string) {
+	cfg := defaultConfig()
+	cfg.Timeout = time.Minute
+	addr := defaultClusterAddr
+	fs := flag.NewFlagSet("capstone coordinator", flag.ExitOnError)
+	registerFlags(fs, &cfg)
+	fs.StringVar(&addr, "addr", addr, "listen address, host:port or unix:<path>")
+	fs.DurationVar(&cfg.Lease, "lease", cfg.Lease, "job lease; workers heartbeat at a third of it")
+	_ = fs.Parse(args)
+
+	if err := validateConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Lease <= 0 {
+		log.Fatal("lease must be positive")
+	}
+
+	logger := NewLogger("capstone")
+	registry := defaultRegistry()
+	runID, store, pending, err := openRun(cfg, registry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	ln, err := listenCluster(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	finished := make(chan struct{})
+	sig := watchSignals(logger, runID, cfg.Drain, cancel, finished)
+
+	logger.Info("coordinator start",
+		Str("run", runID),
+		Str("addr", addr),
+		Int("jobs", len(pending)),
+		Duration("lease", cfg.Lease),
+		Duration("timeout", cfg.Timeout),
+		Int("max_attempts", cfg.Retry.MaxAttempts),
+	)
+
+	r := &runner{
+		cfg:      cfg,
+		logger:   logger,
+		runID:    runID,
+		store:    store,
+		dlq:      newDeadLetterQueue(cfg.DLQPath),
+		registry: registry,
+		stop:     sig.stop,
+		clock:    realClock{},
+	}
+	summary := r.coordinate(ctx, ln, pending)
+	close(finished)
+	summary.Status = runStatus(ctx, sig.interrupted())
+
+	logger.Info("run summary",
+		Str("run", runID),
+		Str("status", summary.Status),
+		Int("handled", summary.Handled),
+		Int("failed", summary.Failed),
+		Int("canceled", summary.Canceled),
+		Int("retried", summary.Retried),
+		Int("dead_lettered", summary.DeadLettered),
+		Int("skipped", summary.Skipped),
+		Int("reassigned", summary.Reassigned),
+		Int("pending", summary.Jobs-summary.Handled-summary.Skipped+summary.Canceled),
+		Duration("cost", summary.Elapsed),
+	)
+	logWaits(logger, runID, summary)
+	logReport(logger, cfg, newReport(runID, summary))
+}
+
+func listenCluster(addr string) (net.Listener, error) {
+	network, address := clusterNetwork(addr)
+	if network == "unix" {
+		// A coordinator that crashed leaves its socket file behind.
+		_ = os.Remove(address)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+func clusterNetwork(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// coordinate is run for remote workers: jobs go out as leases to whichever
+// worker asked for one, and a lease that is not kept alive by heartbeats, or
+// whose worker disconnects, puts the job back in the queue. Per-kind rates
+// and caps apply to leases as they do to local dispatch.
+func (r *runner) coordinate(ctx context.Context, ln net.Listener, pending []job) Summary {
+	start := time.Now()
+	events := make(chan peerEvent)
+	quit := make(chan struct{})
+	defer close(quit)
+	go acceptPeers(ln, events, quit)
+	defer ln.Close()
+
+	summary := Summary{
+		Jobs:       len(pending),
+		Waits:      make(map[string]WaitStats),
+		TokenWaits: make(map[string]WaitStats),
+		Stats:      newRunStats(start),
+	}
+
+	queue := newScheduler(r.cfg.KindWeights)
+	limits := newLimiter(r.cfg.KindRates, r.cfg.KindCaps, start)
+	queue.allow = func(kind string) bool { return limits.allow(kind, time.Now()) }
+	graph, ready := newDAG(pending)
+	for _, j := range ready {
+		j.enqueuedAt = start
+		queue.push(j)
+	}
+
+	peers := make(map[int]*peer)
+	leases := make(map[int]*lease)
+	lost := make(map[int]int)
+	var idle []*peer
+	nextLease := 0
+
+	ticker := time.NewTicker(r.cfg.Lease / 4)
+	defer ticker.Stop()
+
+	complete := func(l *lease, res result) {
+		delete(leases, l.id)
+		limits.release(l.job.Kind)
+		r.finish(l.job, &res, l.start)
+		r.logResult(res)
+		now := time.Now()
+		for _, j := range r.settle(&summary, graph, res, now) {
+			j.enqueuedAt = now
+			queue.push(j)
+		}
+	}
+
+	release := func(l *lease, reason string) {
+		lost[l.job.ID]++
+		fields := []Field{
+			Str("run", r.runID),
+			Int("worker", l.peer.id),
+			Str("name", l.peer.name),
+			Int("job", l.job.ID),
+			Int("lease", l.id),
+			Str("reason", reason),
+		}
+		if lost[l.job.ID] >= r.cfg.Retry.MaxAttempts {
+			err := fmt.Errorf("job %d: %s %d times: %w", l.job.ID, reason, lost[l.job.ID], errLeaseLost)
+			complete(l, result{job: l.job, worker: l.peer.id, err: err, attempts: lost[l.job.ID]})
+			return
+		}
+		delete(leases, l.id)
+		limits.release(l.job.Kind)
+		l.job.enqueuedAt = time.Now()
+		queue.push(l.job)
+		summary.Reassigned++
+		r.logger.Info("job reassigned", fields...)
+	}
+
+	stopLeasing := func() {
+		for _, p := range idle {
+			_ = p.send(clusterMsg{Type: msgDone})
+		}
+		idle = nil
+	}
+
+	var refill *time.Timer
+	defer func() {
+		if refill != nil {
+			refill.Stop()
+		}
+	}()
+
+	done, stop := ctx.Done(), r.stop
+	dispatching := true
+	for len(leases) > 0 || (dispatching && queue.len() > 0) {
+		for dispatching && len(idle) > 0 {
+			next, ok := queue.peek()
+			if !ok {
+				break
+			}
+			p := idle[0]
+			idle = idle[1:]
+			queue.take(next)
+			j := next.job
+			nextLease++
+			now := time.Now()
+			l := &lease{id: nextLease, job: j, peer: p, start: now, deadline: now.Add(r.cfg.Lease)}
+			err := p.send(clusterMsg{
+				Type:        msgJob,
+				Lease:       l.id,
+				Job:         j.ID,
+				Kind:        j.Kind,
+				Priority:    j.Priority,
+				Payload:     j.Payload,
+				Heartbeat:   r.cfg.Lease / 3,
+				MaxAttempts: r.cfg.Retry.MaxAttempts,
+				Backoff:     r.cfg.Retry.BaseDelay,
+				MaxBackoff:  r.cfg.Retry.MaxDelay,
+			})
+			if err != nil {
+				// The reader sees the broken connection and reports the disconnect.
+				_ = p.conn.Close()
+				queue.push(j)
+				continue
+			}
+			leases[l.id] = l
+			j.tokenWait = limits.waited(j.Kind, now)
+			limits.take(j.Kind, now)
+			summary.addWait(j, now.Sub(j.enqueuedAt))
+			summary.addTokenWait(j)
+			if err := r.store.Start(j.ID, p.id); err != nil {
+				r.logger.Error("wal write failed", Str("run", r.runID), Int("job", j.ID), Err(err))
+			}
+		}
+
+		// A worker waiting on a rate-limited kind is served once it refills.
+		if refill != nil {
+			refill.Stop()
+		}
+		refill = nil
+		var refilled <-chan time.Time
+		if dispatching && len(idle) > 0 && queue.len() > 0 {
+			if at, ok := limits.nextToken(time.Now()); ok {
+				refill = time.NewTimer(time.Until(at))
+				refilled = refill.C
+			}
+		}
+
+		select {
+		case <-refilled:
+		case ev := <-events:
+			p, msg := ev.peer, ev.msg
+			if ev.err != nil {
+				if _, ok := peers[p.id]; ok {
+					delete(peers, p.id)
+					r.logger.Info("worker left", Str("run", r.runID), Int("worker", p.id), Str("name", p.name))
+				}
+				idle = removePeer(idle, p)
+				for _, l := range sortedLeases(leases) {
+					if l.peer == p {
+						release(l, "worker disconnected")
+					}
+				}
+				continue
+			}
+			switch msg.Type {
+			case msgHello:
+				p.name = msg.Worker
+				peers[p.id] = p
+				summary.Stats.addWorker(p.id)
+				r.logger.Info("worker joined", Str("run", r.runID), Int("worker", p.id), Str("name", p.name))
+			case msgLease:
+				if dispatching {
+					idle = append(idle, p)
+				} else {
+					_ = p.send(clusterMsg{Type: msgDone})
+				}
+			case msgHeartbeat:
+				if l, ok := leases[msg.Lease]; ok && l.peer == p {
+					l.deadline = time.Now().Add(r.cfg.Lease)
+				}
+			case msgResult:
+				l, ok := leases[msg.Lease]
+				if !ok || l.peer != p {
+					r.logger.Info("stale result ignored", Str("run", r.runID), Int("worker", p.id), Int("job", msg.Job), Int("lease", msg.Lease))
+					continue
+				}
+				res := result{job: l.job, worker: p.id, attempts: msg.Attempts}
+				if msg.Err != "" {
+					res.err = remoteErr(msg.Err, msg.ErrKind)
+				}
+				complete(l, res)
+			default:
+				r.logger.Error("unknown message", Str("run", r.runID), Int("worker", p.id), Str("type", msg.Type))
+			}
+		case now := <-ticker.C:
+			for _, l := range sortedLeases(leases) {
+				if now.After(l.deadline) {
+					release(l, "lease expired")
+				}
+			}
+		case <-done:
+			dispatching, done, stop = false, nil, nil
+			stopLeasing()
+			for _, l := range sortedLeases(leases) {
+				_ = l.peer.send(clusterMsg{Type: msgDone})
+				complete(l, result{job: l.job, worker: l.peer.id, err: ctx.Err(), attempts: 1})
+			}
+		case <-stop:
+			dispatching, stop = false, nil
+			stopLeasing()
+		}
+	}
+
+	for _, p := range peers {
+		_ = p.send(clusterMsg{Type: msgDone})
+		_ = p.conn.Close()
+	}
+	if n := graph.waiting(); n > 0 {
+		r.logger.Info("jobs left waiting on dependencies", Str("run", r.runID), Int("jobs", n))
+	}
+	summary.Elapsed = time.Since(start)
+	return summary
+}
+
+func acceptPeers(ln net.Listener, events chan<- peerEvent, quit <-chan struct{}) {
+	for id := 1; ; id++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		p := &peer{id: id, conn: conn, enc: json.NewEncoder(conn)}
+		go p.read(events, quit)
+	}
+}
+
+func (p *peer) read(events chan<- peerEvent, quit <-chan struct{}) {
+	defer p.conn.Close()
+	dec := json.NewDecoder(p.conn)
+	for {
+		var msg clusterMsg
+		err := dec.Decode(&msg)
+		select {
+		case events <- peerEvent{peer: p, msg: msg, err: err}:
+		case <-quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *peer) send(msg clusterMsg) error {
+	_ = p.conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+	return p.enc.Encode(msg)
+}
+
+func removePeer(peers []*peer, p *peer) []*peer {
+	out := peers[:0]
+	for _, q := range peers {
+		if q != p {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+func sortedLeases(leases map[int]*lease) []*lease {
+	out := make([]*lease, 0, len(leases))
+	for _, l := range leases {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+type clusterWorker struct {
+	name     string
+	logger   *Logger
+	registry *Registry
+	stop     <-chan struct{}
+}
+
+func workerMain(args []string) {
+	addr := defaultClusterAddr
+	slots := 1
+	drain := 2 * time.Second
+	host, _ := os.Hostname()
+	name := host + "-" + strconv.Itoa(os.Getpid())
+	fs := flag.NewFlagSet("capstone worker", flag.ExitOnError)
+	fs.StringVar(&addr, "addr", addr, "coordinator address, host:port or unix:<path>")
+	fs.IntVar(&slots, "workers", slots, "jobs this process runs at once")
+	fs.StringVar(&name, "name", name, "worker name reported to the coordinator")
+	fs.DurationVar(&drain, "drain", drain, "time in-flight jobs get to finish after SIGINT/SIGTERM")
+	_ = fs.Parse(args)
+	if slots <= 0 {
+		log.Fatal("workers must be positive")
+	}
+
+	logger := NewLogger("capstone")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	finished := make(chan struct{})
+	sig := watchSignals(logger, name, drain, cancel, finished)
+
+	w := &clusterWorker{name: name, logger: logger, registry: defaultRegistry(), stop: sig.stop}
+	logger.Info("worker start", Str("name", name), Str("addr", addr), Int("workers", slots))
+
+	var wg sync.WaitGroup
+	for slot := 1; slot <= slots; slot++ {
+		wg.Add(1)
+		go func(slot int) {
+			defer wg.Done()
+			if err := w.serve(ctx, addr, slot); err != nil {
+				logger.Error("worker stopped", Str("name", name), Int("slot", slot), Err(err))
+			}
+		}(slot)
+	}
+	wg.Wait()
+	close(finished)
+	logger.Info("worker exit", Str("name", name))
+}
+
+// serve holds one connection to the coordinator and runs the jobs leased on
+// it one at a time. Jobs cut short by shutdown are not reported: the
+// coordinator sees the connection drop and reassigns them.
+func (w *clusterWorker) serve(ctx context.Context, addr string, slot int) error {
+	network, address := clusterNetwork(addr)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return fmt.Errorf("dial coordinator: %w", err)
+	}
+	defer conn.Close()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	msgs := make(chan clusterMsg)
+	go func() {
+		defer close(msgs)
+		dec := json.NewDecoder(conn)
+		for {
+			var msg clusterMsg
+			if err := dec.Decode(&msg); err != nil {
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	send := func(msg clusterMsg) error {
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("send %s: %w", msg.Type, err)
+		}
+		return nil
+	}
+
+	name := w.name + "/" + strconv.Itoa(slot)
+	if err := send(clusterMsg{Type: msgHello, Worker: name}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-w.stop:
+			return nil
+		default:
+		}
+		if err := send(clusterMsg{Type: msgLease}); err != nil {
+			return err
+		}
+
+		var msg clusterMsg
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return errors.New("coordinator closed the connection")
+			}
+			msg = m
+		case <-w.stop:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		if msg.Type == msgDone {
+			return nil
+		}
+		if msg.Type != msgJob {
+			return fmt.Errorf("unexpected %q message", msg.Type)
+		}
+
+		jobCtx, cancelJob := context.WithCancel(ctx)
+		out := make(chan clusterMsg, 1)
+		go func() {
+			out <- w.runLease(jobCtx, name, msg)
+		}()
+
+		heartbeat := time.NewTicker(msg.Heartbeat)
+		var res clusterMsg
+	wait:
+		for {
+			select {
+			case res = <-out:
+				break wait
+			case <-heartbeat.C:
+				if err := send(clusterMsg{Type: msgHeartbeat, Lease: msg.Lease, Job: msg.Job}); err != nil {
+					w.logger.Error("heartbeat failed", Str("name", name), Int("job", msg.Job), Err(err))
+				}
+			case m, ok := <-msgs:
+				if !ok || m.Type == msgDone {
+					cancelJob()
+					<-out
+					heartbeat.Stop()
+					return nil
+				}
+			}
+		}
+		heartbeat.Stop()
+		cancelJob()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := send(res); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *clusterWorker) runLease(ctx context.Context, name string, msg clusterMsg) clusterMsg {
+	j := job{ID: msg.Job, Kind: msg.Kind, Priority: msg.Priority, Payload: msg.Payload}
+	policy := RetryPolicy{
+		MaxAttempts: msg.MaxAttempts,
+		BaseDelay:   msg.Backoff,
+		MaxDelay:    msg.MaxBackoff,
+		Fatal:       []error{errJobFatal},
+	}
+	res := clusterMsg{Type: msgResult, Lease: msg.Lease, Job: j.ID}
+	jobStart := time.Now()
+
+	impl, err := w.registry.Build(j)
+	if err != nil {
+		res.Attempts = 1
+	} else {
+		for {
+			res.Attempts++
+			err = impl.Run(ctx, res.Attempts)
+			if !policy.Retryable(err) || res.Attempts >= policy.MaxAttempts {
+				break
+			}
+			wait := policy.Backoff(res.Attempts + 1)
+			w.logger.Info("job retry",
+				Str("name", name),
+				Int("job", j.ID),
+				Int("attempt", res.Attempts),
+				Duration("backoff", wait),
+				Err(err),
+			)
+			if err = sleepCtx(ctx, wait); err != nil {
+				break
+			}
+		}
+	}
+
+	fields := []Field{
+		Str("name", name),
+		Int("job", j.ID),
+		Str("kind", j.Kind),
+		Int("lease", msg.Lease),
+		Int("attempts", res.Attempts),
+		Duration("cost", time.Since(jobStart)),
+	}
+	if err != nil {
+		res.Err, res.ErrKind = err.Error(), errKindOf(err)
+		w.logger.Error("job failed", append(fields, Err(err))...)
+	} else {
+		w.logger.Info("job done", fields...)
+	}
+	return res
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoordinatorReassignsExpiredLease(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.WALDir = dir
+	cfg.DLQPath = filepath.Join(dir, "dead-letter.jsonl")
+	cfg.Lease = 100 * time.Millisecond
+
+	jobs := []job{{ID: 1, Kind: "noop", Priority: priorityNormal}}
+	store, err := createJobStore(dir, "run-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Begin(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewRegistry()
+	registry.Register("noop", func(int, json.RawMessage) (Job, error) {
+		return JobFunc(func(context.Context, int) error { return nil }), nil
+	})
+	logger := &Logger{service: "capstone", logger: log.New(io.Discard, "", 0)}
+	r := &runner{
+		cfg:      cfg,
+		logger:   logger,
+		runID:    "run-test",
+		store:    store,
+		dlq:      newDeadLetterQueue(cfg.DLQPath),
+		registry: registry,
+		clock:    realClock{},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The first worker takes the lease and then hangs without heartbeats.
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		stalled <- conn
+		enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+		_ = enc.Encode(clusterMsg{Type: msgHello, Worker: "stalled"})
+		_ = enc.Encode(clusterMsg{Type: msgLease})
+		var msg clusterMsg
+		_ = dec.Decode(&msg)
+
+		w := &clusterWorker{name: "healthy", logger: logger, registry: registry}
+		_ = w.serve(ctx, addr, 1)
+	}()
+
+	summary := r.coordinate(ctx, ln, jobs)
+	(<-stalled).Close()
+
+	if summary.Handled != 1 || summary.Failed != 0 {
+		t.Fatalf("handled=%d failed=%d, want 1 and 0", summary.Handled, summary.Failed)
+	}
+	if summary.Reassigned != 1 {
+		t.Fatalf("reassigned = %d, want 1", summary.Reassigned)
+	}
+}
+
+func TestCoordinatorAppliesKindLimits(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.WALDir, cfg.DLQPath = dir, filepath.Join(dir, "dead-letter.jsonl")
+	cfg.KindRates = kindRates{"http": {PerSecond: 20, Burst: 1}}
+	cfg.KindCaps = kindCaps{"shell": 1}
+
+	var jobs []job
+	for i := 1; i <= 8; i++ {
+		kind := "http"
+		if i%2 == 0 {
+			kind = "shell"
+		}
+		jobs = append(jobs, job{ID: i, Kind: kind, Priority: priorityNormal})
+	}
+	store, err := createJobStore(dir, "run-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Begin(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var httpStarts []time.Time
+	var shells, maxShells atomic.Int32
+	registry := NewRegistry()
+	registry.Register("http", func(int, json.RawMessage) (Job, error) {
+		return JobFunc(func(context.Context, int) error {
+			mu.Lock()
+			httpStarts = append(httpStarts, time.Now())
+			mu.Unlock()
+			return nil
+		}), nil
+	})
+	registry.Register("shell", func(int, json.RawMessage) (Job, error) {
+		return JobFunc(func(context.Context, int) error {
+			n := shells.Add(1)
+			if n > maxShells.Load() {
+				maxShells.Store(n)
+			}
+			time.Sleep(20 * time.Millisecond)
+			shells.Add(-1)
+			return nil
+		}), nil
+	})
+	logger := &Logger{service: "capstone", logger: log.New(io.Discard, "", 0)}
+	r := &runner{
+		cfg:      cfg,
+		logger:   logger,
+		runID:    "run-limits",
+		store:    store,
+		dlq:      newDeadLetterQueue(cfg.DLQPath),
+		registry: registry,
+		clock:    realClock{},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w := &clusterWorker{name: "w", logger: logger, registry: registry}
+	for slot := 1; slot <= 3; slot++ {
+		go func(slot int) { _ = w.serve(ctx, ln.Addr().String(), slot) }(slot)
+	}
+
+	summary := r.coordinate(ctx, ln, jobs)
+	if summary.Handled != 8 || summary.Failed != 0 {
+		t.Fatalf("handled=%d failed=%d, want 8 and 0", summary.Handled, summary.Failed)
+	}
+	if n := maxShells.Load(); n != 1 {
+		t.Fatalf("shell jobs in flight at once = %d, want the cap of 1", n)
+	}
+	for i := 1; i < len(httpStarts); i++ {
+		// 20/s with a burst of 1 spaces leases 50ms apart.
+		if gap := httpStarts[i].Sub(httpStarts[i-1]); gap < 40*time.Millisecond {
+			t.Fatalf("http jobs %d and %d started %v apart, want the rate limit's 50ms", i, i+1, gap)
+		}
+	}
+	if summary.TokenWaits["http"].Jobs == 0 {
+		t.Fatal("no token wait recorded for http")
+	}
+}
+
+func TestRemoteErrorKeepsKind(t *testing.T) {
+	policy := defaultRetryPolicy()
+	for _, tc := range []struct {
+		err       error
+		canceled  bool
+		retryable bool
+	}{
+		{fmt.Errorf("job 3: %w", context.Canceled), true, false},
+		{fmt.Errorf("job 3: %w", context.DeadlineExceeded), true, false},
+		{fmt.Errorf("job 3: bad payload: %w", errJobFatal), false, false},
+		{errors.New("job 3: flaky"), false, true},
+	} {
+		got := remoteErr(tc.err.Error(), errKindOf(tc.err))
+		if got.Error() != tc.err.Error() || isCanceled(got) != tc.canceled || policy.Retryable(got) != tc.retryable {
+			t.Errorf("%v: rebuilt %v canceled=%v retryable=%v", tc.err, got, isCanceled(got), policy.Retryable(got))
+		}
+	}
+}
+
+func TestSortedLeases(t *testing.T) {
+	leases := map[int]*lease{9: {id: 9}, 2: {id: 2}, 5: {id: 5}}
+	got := sortedLeases(leases)
+	if len(got) != 3 || got[0].id != 2 || got[1].id != 5 || got[2].id != 9 {
+		t.Fatalf("sorted leases out of order")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	from := time.Date(2026, 3, 27, 10, 17, 30, 0, time.UTC)
+
+	cases := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", from, time.Date(2026, 3, 27, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", from, time.Date(2026, 3, 28, 2, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", from, time.Date(2026, 3, 30, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", from, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: the 1st of the month or any Sunday.
+		{"0 0 1 * sun", from, time.Date(2026, 3, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", from, time.Date(2026, 3, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", from, time.Date(2026, 3, 27, 11, 0, 0, 0, time.UTC)},
+		// 02:30 does not exist in Berlin on the spring-forward day.
+		{"30 2 * * *", from.AddDate(0, 0, 1).In(berlin), time.Date(2026, 3, 30, 2, 30, 0, 0, berlin)},
+		{"@every 90s", from, from.Add(90 * time.Second)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.expr, func(t *testing.T) {
+			sched, err := parseCron(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sched.Next(tc.from); !got.Equal(tc.want) {
+				t.Fatalf("Next = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"0 0 30 feb *",
+		"@every 10ms",
+		"@every soon",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestMissedFires(t *testing.T) {
+	sched, err := parseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+
+	if n := missedFires(sched, last, last.Add(59*time.Minute), 100); n != 0 {
+		t.Fatalf("missed = %d, want 0", n)
+	}
+	if n := missedFires(sched, last, last.Add(5*time.Hour), 100); n != 5 {
+		t.Fatalf("missed = %d, want 5", n)
+	}
+	if n := missedFires(sched, last, last.Add(500*time.Hour), 100); n != 100 {
+		t.Fatalf("missed = %d, want capped 100", n)
+	}
+}
+
+// newTestCron returns a daemon whose runs are short simulations on a virtual
+// clock, with its state kept under dir.
+func newTestCron(t *testing.T, dir, schedule string, catchUp bool) (*cronDaemon, *cronGroup) {
+	t.Helper()
+	base := defaultConfig()
+	base.Jobs, base.Workers, base.Timeout = 3, 2, time.Minute
+	base.WALDir, base.DLQPath = dir, filepath.Join(dir, "dead-letter.jsonl")
+	base.Simulate = true
+	g, err := cronGroupSpec{Group: "nightly", Schedule: schedule}.toGroup(base, time.UTC, catchUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, "cron-state.json")
+	state, err := loadCronState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newSimClock(simEpoch)
+	d := &cronDaemon{
+		logger:    &Logger{service: "capstone", logger: log.New(io.Discard, "", 0), clock: clock},
+		registry:  defaultRegistry(),
+		groups:    []*cronGroup{g},
+		state:     state,
+		statePath: statePath,
+		clock:     clock,
+		tick:      time.Second,
+	}
+	return d, g
+}
+
+func TestCronRestartDoesNotRefire(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	d, g := newTestCron(t, dir, "0 * * * *", true)
+	d.plan(g, at.Add(-30*time.Second))
+	results := make(chan cronResult)
+	if !d.fire(context.Background(), g, at, nil, results) {
+		t.Fatal("first fire did not start a run")
+	}
+	d.finish(<-results)
+
+	// A restart moments later reads the recorded fire and waits for the
+	// next hour, even with catch-up on.
+	d, g = newTestCron(t, dir, "0 * * * *", true)
+	d.plan(g, at.Add(20*time.Second))
+	if g.due {
+		t.Fatal("restart marked the 10:00 fire as missed")
+	}
+	if want := at.Add(time.Hour); !g.next.Equal(want) {
+		t.Fatalf("next = %v, want %v", g.next, want)
+	}
+	if st := d.state.Groups[g.name]; st.LastRun == "" || st.LastStatus != stateDone {
+		t.Fatalf("persisted state = %+v", st)
+	}
+}
+
+func TestCronSkipsOverlappingRun(t *testing.T) {
+	at := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	d, g := newTestCron(t, t.TempDir(), "0 * * * *", false)
+	d.plan(g, at.Add(-time.Minute))
+	results := make(chan cronResult)
+
+	if !d.fire(context.Background(), g, at, nil, results) {
+		t.Fatal("10:00 fire did not start a run")
+	}
+	// The 10:00 run has not been collected, so it still counts as running.
+	if d.fire(context.Background(), g, at.Add(time.Hour), nil, results) {
+		t.Fatal("11:00 fire started a second run of the group")
+	}
+	if last := d.state.Groups[g.name].LastFire; !last.Equal(at.Add(time.Hour)) {
+		t.Fatalf("skipped fire not recorded: last fire = %v", last)
+	}
+	if want := at.Add(2 * time.Hour); !g.next.Equal(want) {
+		t.Fatalf("next = %v, want %v", g.next, want)
+	}
+
+	d.finish(<-results)
+	if !d.fire(context.Background(), g, at.Add(2*time.Hour), nil, results) {
+		t.Fatal("12:00 fire did not start a run after the previous one finished")
+	}
+	d.finish(<-results)
+}
+
+func TestCronCatchUp(t *testing.T) {
+	last := time.Date(2026, 1, 1, 7, 0, 0, 0, time.UTC)
+	now := last.Add(3*time.Hour + 30*time.Minute)
+
+	for _, catchUp := range []bool{false, true} {
+		dir := t.TempDir()
+		state := cronState{Groups: map[string]cronGroupState{"nightly": {LastFire: last}}}
+		if err := state.save(filepath.Join(dir, "cron-state.json")); err != nil {
+			t.Fatal(err)
+		}
+		d, g := newTestCron(t, dir, "0 * * * *", catchUp)
+		d.plan(g, now)
+		if g.due != catchUp {
+			t.Fatalf("catch_up=%v: due = %v", catchUp, g.due)
+		}
+		if want := time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC); !g.next.Equal(want) {
+			t.Fatalf("catch_up=%v: next = %v, want %v", catchUp, g.next, want)
+		}
+	}
+}
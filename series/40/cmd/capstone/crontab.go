@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const maxMissedFires = 1000
+
+type cronGroupSpec struct {
+	Group    string `json:"group"`
+	Schedule string `json:"schedule"`
+	TZ       string `json:"tz"`
+	CatchUp  *bool  `json:"catch_up"`
+	JobsFile string `json:"jobs_file"`
+	Jobs     int    `json:"jobs"`
+	Workers  int    `json:"workers"`
+	Timeout  string `json:"timeout"`
+}
+
+type cronGroup struct {
+	name    string
+	sched   cronSchedule
+	loc     *time.Location
+	catchUp bool
+	cfg     Config
+	next    time.Time
+	due     bool
+	running bool
+}
+
+type cronState struct {
+	Groups map[string]cronGroupState `json:"groups"`
+}
+
+type cronGroupState struct {
+	LastFire   time.Time `json:"last_fire"`
+	LastRun    string    `json:"last_run,omitempty"`
+	LastStatus string    `json:"last_status,omitempty"`
+}
+
+type cronResult struct {
+	group   *cronGroup
+	runID   string
+	summary Summary
+	err     error
+}
+
+type cronDaemon struct {
+	logger    *Logger
+	registry  *Registry
+	groups    []*cronGroup
+	state     cronState
+	statePath string
+	clock     Clock
+	tick      time.Duration
+}
+
+func cronMain(args []string) {
+	cfg := defaultConfig()
+	cfg.Timeout = time.Minute
+	schedulePath := ""
+	statePath := filepath.Join("series", "40", "tmp", "cron-state.json")
+	tz := "Local"
+	catchUp := false
+	fs := flag.NewFlagSet("capstone cron", flag.ExitOnError)
+	registerFlags(fs, &cfg)
+	registerAutoscaleFlags(fs, &cfg)
+	fs.StringVar(&schedulePath, "schedule", schedulePath, "JSON lines file of job groups (group, schedule, jobs_file, ...)")
+	fs.StringVar(&statePath, "state", statePath, "file recording the last fire of each group")
+	fs.StringVar(&tz, "tz", tz, "time zone cron expressions are evaluated in")
+	fs.BoolVar(&catchUp, "catch-up", catchUp, "run once for fires missed while down, unless a group sets catch_up")
+	_ = fs.Parse(args)
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if schedulePath == "" {
+		log.Fatal("schedule is required")
+	}
+	cfg.Resume = ""
+	cfg.ReplayDLQ = false
+	groups, err := loadCronGroups(schedulePath, cfg, loc, catchUp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	state, err := loadCronState(statePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger := NewLogger("capstone")
+	d := &cronDaemon{
+		logger:    logger,
+		registry:  defaultRegistry(),
+		groups:    groups,
+		state:     state,
+		statePath: statePath,
+		clock:     realClock{},
+		tick:      time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	sig := watchSignals(logger, "cron", cfg.Drain, cancel, finished)
+
+	logger.Info("cron start", Str("schedule", schedulePath), Str("tz", loc.String()), Int("groups", len(groups)))
+	d.run(ctx, sig.stop)
+	close(finished)
+	logger.Info("cron stop")
+}
+
+func loadCronGroups(path string, base Config, loc *time.Location, catchUp bool) ([]*cronGroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open schedule: %w", err)
+	}
+	defer f.Close()
+
+	var groups []*cronGroup
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := strings.TrimSpace(sc.Text())
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+
+		var spec cronGroupSpec
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("schedule line %d: %w", line, err)
+		}
+		g, err := spec.toGroup(base, loc, catchUp)
+		if err != nil {
+			return nil, fmt.Errorf("schedule line %d: %w", line, err)
+		}
+		if seen[g.name] {
+			return nil, fmt.Errorf("schedule line %d: duplicate group %q", line, g.name)
+		}
+		seen[g.name] = true
+		groups = append(groups, g)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read schedule: %w", err)
+	}
+	if len(groups) == 0 {
+		return nil, errors.New("schedule has no groups")
+	}
+	return groups, nil
+}
+
+func (s cronGroupSpec) toGroup(base Config, loc *time.Location, catchUp bool) (*cronGroup, error) {
+	if s.Group == "" {
+		return nil, errors.New("group is required")
+	}
+	sched, err := parseCron(s.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	if s.TZ != "" {
+		if loc, err = time.LoadLocation(s.TZ); err != nil {
+			return nil, err
+		}
+	}
+	if s.CatchUp != nil {
+		catchUp = *s.CatchUp
+	}
+
+	cfg := base
+	if s.JobsFile != "" {
+		cfg.JobsFile = s.JobsFile
+	}
+	if s.Jobs != 0 {
+		cfg.Jobs = s.Jobs
+	}
+	if s.Workers != 0 {
+		cfg.Workers = s.Workers
+	}
+	if s.Timeout != "" {
+		if cfg.Timeout, err = time.ParseDuration(s.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	if cfg.ReportPath != "" {
+		cfg.ReportPath = strings.TrimSuffix(cfg.ReportPath, filepath.Ext(cfg.ReportPath)) + "-" + s.Group
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("group %s: %w", s.Group, err)
+	}
+	return &cronGroup{name: s.Group, sched: sched, loc: loc, catchUp: catchUp, cfg: cfg}, nil
+}
+
+func loadCronState(path string) (cronState, error) {
+	state := cronState{Groups: make(map[string]cronGroupState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read cron state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("decode cron state: %w", err)
+	}
+	if state.Groups == nil {
+		state.Groups = make(map[string]cronGroupState)
+	}
+	return state, nil
+}
+
+// save replaces the state file through a rename so a crash mid-write leaves
+// the previous state intact.
+func (s cronState) save(path string) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("create cron state dir: %w", err)
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode cron state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write cron state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write cron state: %w", err)
+	}
+	return nil
+}
+
+func (d *cronDaemon) run(ctx context.Context, stop <-chan struct{}) {
+	now := d.clock.Now()
+	for _, g := range d.groups {
+		d.plan(g, now)
+	}
+
+	ticker := d.clock.NewTicker(d.tick)
+	defer ticker.Stop()
+	results := make(chan cronResult)
+	running := 0
+	stopping := false
+	watch := stop
+
+	for !stopping || running > 0 {
+		if !stopping {
+			now := d.clock.Now()
+			for _, g := range d.groups {
+				if g.due || !g.next.After(now) {
+					if d.fire(ctx, g, now, stop, results) {
+						running++
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C():
+		case res := <-results:
+			running--
+			d.finish(res)
+		case <-watch:
+			stopping, watch = true, nil
+			d.logger.Info("cron draining", Int("running", running))
+		}
+	}
+}
+
+// plan sets the group's first fire after a (re)start. Fires at or before the
+// recorded last fire already happened, so a restart never repeats them.
+func (d *cronDaemon) plan(g *cronGroup, now time.Time) {
+	last := d.state.Groups[g.name].LastFire
+	if last.IsZero() {
+		g.next = g.sched.Next(now.In(g.loc))
+	} else {
+		from := last
+		if now.After(from) {
+			from = now
+		}
+		g.next = g.sched.Next(from.In(g.loc))
+		if missed := missedFires(g.sched, last.In(g.loc), now, maxMissedFires); missed > 0 {
+			g.due = g.catchUp
+			d.logger.Info("cron missed fires",
+				Str("group", g.name),
+				Int("missed", missed),
+				Str("last_fire", last.Format(time.RFC3339)),
+				Str("catch_up", fmt.Sprint(g.catchUp)),
+			)
+		}
+	}
+	d.logger.Info("cron group", Str("group", g.name), Str("next", g.next.Format(time.RFC3339)))
+}
+
+func (d *cronDaemon) fire(ctx context.Context, g *cronGroup, now time.Time, stop <-chan struct{}, results chan<- cronResult) bool {
+	at, reason := g.next, "schedule"
+	if g.due {
+		at, reason = now, "catch-up"
+	} else {
+		next := g.sched.Next(at.In(g.loc))
+		if !next.After(now) {
+			next = g.sched.Next(now.In(g.loc))
+		}
+		g.next = next
+	}
+	g.due = false
+
+	// Skipped fires are recorded too, so they are not mistaken for downtime.
+	st := d.state.Groups[g.name]
+	st.LastFire = at
+	d.state.Groups[g.name] = st
+	if err := d.state.save(d.statePath); err != nil {
+		d.logger.Error("cron state write failed", Str("group", g.name), Err(err))
+	}
+	if g.running {
+		d.logger.Info("cron fire skipped", Str("group", g.name), Str("at", at.Format(time.RFC3339)), Str("reason", "previous run still running"))
+		return false
+	}
+
+	g.running = true
+	d.logger.Info("cron fire", Str("group", g.name), Str("at", at.Format(time.RFC3339)), Str("reason", reason), Str("next", g.next.Format(time.RFC3339)))
+	go func() {
+		results <- d.execute(ctx, g, stop)
+	}()
+	return true
+}
+
+func (d *cronDaemon) execute(ctx context.Context, g *cronGroup, stop <-chan struct{}) cronResult {
+	res := cronResult{group: g}
+	runID, store, pending, err := openRun(g.cfg, d.registry)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer store.Close()
+	res.runID = runID
+
+	runCtx, cancel := context.WithTimeout(ctx, g.cfg.Timeout)
+	defer cancel()
+	r := &runner{
+		cfg:      g.cfg,
+		logger:   d.logger,
+		runID:    runID,
+		store:    store,
+		dlq:      newDeadLetterQueue(g.cfg.DLQPath),
+		registry: d.registry,
+		stop:     stop,
+		clock:    d.clock,
+	}
+	res.summary = r.run(runCtx, pending)
+	interrupted := false
+	select {
+	case <-stop:
+		interrupted = true
+	default:
+	}
+	res.summary.Status = runStatus(runCtx, interrupted)
+	logReport(d.logger, g.cfg, newReport(runID, res.summary))
+	return res
+}
+
+func (d *cronDaemon) finish(res cronResult) {
+	g := res.group
+	g.running = false
+
+	st := d.state.Groups[g.name]
+	if res.err != nil {
+		st.LastStatus = "error"
+		d.logger.Error("cron run failed", Str("group", g.name), Err(res.err))
+	} else {
+		st.LastRun, st.LastStatus = res.runID, res.summary.Status
+		d.logger.Info("cron run finished",
+			Str("group", g.name),
+			Str("run", res.runID),
+			Str("status", res.summary.Status),
+			Int("handled", res.summary.Handled),
+			Int("failed", res.summary.Failed),
+			Int("dead_lettered", res.summary.DeadLettered),
+			Int("skipped", res.summary.Skipped),
+			Duration("cost", res.summary.Elapsed),
+		)
+	}
+	d.state.Groups[g.name] = st
+	if err := d.state.save(d.statePath); err != nil {
+		d.logger.Error("cron state write failed", Str("group", g.name), Err(err))
+	}
+}
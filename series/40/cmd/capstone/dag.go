@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errJobSkipped = errors.New("job skipped")
+
+type dag struct {
+	jobs     map[int]job
+	children map[int][]int
+	unmet    map[int]int
+}
+
+// newDAG returns the graph and the jobs that are ready right away. Edges to
+// jobs outside the set (already finished on resume, or left behind by a
+// dead-letter replay) count as satisfied.
+func newDAG(jobs []job) (*dag, []job) {
+	d := &dag{
+		jobs:     make(map[int]job, len(jobs)),
+		children: make(map[int][]int),
+		unmet:    make(map[int]int),
+	}
+	for _, j := range jobs {
+		d.jobs[j.ID] = j
+	}
+
+	var ready []job
+	for _, j := range jobs {
+		for _, dep := range j.DependsOn {
+			if _, ok := d.jobs[dep]; ok {
+				d.children[dep] = append(d.children[dep], j.ID)
+				d.unmet[j.ID]++
+			}
+		}
+		if d.unmet[j.ID] == 0 {
+			ready = append(ready, j)
+		}
+	}
+	return d, ready
+}
+
+func (d *dag) waiting() int {
+	return len(d.unmet)
+}
+
+func (d *dag) complete(id int) []job {
+	var ready []job
+	for _, child := range d.children[id] {
+		n, ok := d.unmet[child]
+		if !ok {
+			continue
+		}
+		if n > 1 {
+			d.unmet[child] = n - 1
+			continue
+		}
+		delete(d.unmet, child)
+		ready = append(ready, d.jobs[child])
+	}
+	return ready
+}
+
+func (d *dag) skip(id int) []job {
+	var skipped []job
+	stack := append([]int(nil), d.children[id]...)
+	for len(stack) > 0 {
+		child := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := d.unmet[child]; !ok {
+			continue
+		}
+		delete(d.unmet, child)
+		skipped = append(skipped, d.jobs[child])
+		stack = append(stack, d.children[child]...)
+	}
+	sort.Slice(skipped, func(i, j int) bool {
+		return skipped[i].ID < skipped[j].ID
+	})
+	return skipped
+}
+
+func validateDAG(jobs []job) error {
+	ids := make(map[int]bool, len(jobs))
+	for _, j := range jobs {
+		ids[j.ID] = true
+	}
+	deps := make(map[int][]int, len(jobs))
+	for _, j := range jobs {
+		for _, dep := range j.DependsOn {
+			if !ids[dep] {
+				return fmt.Errorf("job %d depends on unknown job %d", j.ID, dep)
+			}
+		}
+		deps[j.ID] = j.DependsOn
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[int]int, len(jobs))
+	var path []int
+	var visit func(id int) error
+	visit = func(id int) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, p := range path {
+				if p == id {
+					start = i
+				}
+			}
+			return fmt.Errorf("dependency cycle: %s", joinIDs(append(path[start:], id), " -> "))
+		}
+		state[id] = visiting
+		path = append(path, id)
+		for _, dep := range deps[id] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		return nil
+	}
+
+	for _, j := range jobs {
+		if err := visit(j.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// criticalPath returns the chain of finished jobs with the largest summed
+// cost, following depends_on edges.
+func criticalPath(costs map[int]time.Duration, deps map[int][]int) ([]int, time.Duration) {
+	finish := make(map[int]time.Duration, len(costs))
+	prev := make(map[int]int, len(costs))
+	var walk func(id int) time.Duration
+	walk = func(id int) time.Duration {
+		if f, ok := finish[id]; ok {
+			return f
+		}
+		var best time.Duration
+		bestDep := 0
+		for _, dep := range deps[id] {
+			if _, ok := costs[dep]; !ok {
+				continue
+			}
+			if f := walk(dep); f > best {
+				best, bestDep = f, dep
+			}
+		}
+		finish[id] = best + costs[id]
+		prev[id] = bestDep
+		return finish[id]
+	}
+
+	ids := make([]int, 0, len(costs))
+	for id := range costs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	end, total := 0, time.Duration(-1)
+	for _, id := range ids {
+		if f := walk(id); f > total {
+			end, total = id, f
+		}
+	}
+	if total < 0 {
+		return nil, 0
+	}
+
+	var path []int
+	for id := end; id != 0; id = prev[id] {
+		path = append([]int{id}, path...)
+	}
+	return path, total
+}
+
+func joinIDs(ids []int, sep string) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateDAGRejectsCycle(t *testing.T) {
+	jobs := []job{
+		{ID: 1, DependsOn: []int{3}},
+		{ID: 2, DependsOn: []int{1}},
+		{ID: 3, DependsOn: []int{2}},
+	}
+
+	err := validateDAG(jobs)
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle: 1 -> 3 -> 2 -> 1") {
+		t.Fatalf("err = %v, want dependency cycle", err)
+	}
+}
+
+func TestValidateDAGRejectsUnknownDependency(t *testing.T) {
+	if err := validateDAG([]job{{ID: 1, DependsOn: []int{9}}}); err == nil {
+		t.Fatal("expected error for unknown dependency")
+	}
+}
+
+func TestDAGSkipsDescendants(t *testing.T) {
+	g, ready := newDAG([]job{
+		{ID: 1},
+		{ID: 2, DependsOn: []int{1}},
+		{ID: 3, DependsOn: []int{2}},
+		{ID: 4, DependsOn: []int{1}},
+		{ID: 5},
+	})
+	if len(ready) != 2 || ready[0].ID != 1 || ready[1].ID != 5 {
+		t.Fatalf("ready = %v, want jobs 1 and 5", ready)
+	}
+
+	next := g.complete(1)
+	if len(next) != 2 {
+		t.Fatalf("complete(1) released %d jobs, want 2", len(next))
+	}
+	skipped := g.skip(2)
+	if len(skipped) != 1 || skipped[0].ID != 3 {
+		t.Fatalf("skip(2) = %v, want job 3", skipped)
+	}
+	if n := g.waiting(); n != 0 {
+		t.Fatalf("waiting = %d, want 0", n)
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	costs := map[int]time.Duration{1: 10, 2: 50, 3: 20, 4: 5}
+	deps := map[int][]int{2: {1}, 3: {1}, 4: {2, 3}}
+
+	path, cost := criticalPath(costs, deps)
+	if joinIDs(path, ",") != "1,2,4" || cost != 65 {
+		t.Fatalf("critical path = %v (%v), want 1,2,4 (65)", path, cost)
+	}
+}
+
+func TestSkippedJobNotDeadLettered(t *testing.T) {
+	dir := t.TempDir()
+	store, err := createJobStore(dir, "run-skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.noSync = true
+	jobs := []job{{ID: 1, Kind: "noop"}, {ID: 2, Kind: "noop", DependsOn: []int{1}}}
+	if err := store.Begin(jobs); err != nil {
+		t.Fatal(err)
+	}
+	dlqPath := filepath.Join(dir, "dead-letter.jsonl")
+	r := &runner{
+		runID:  "run-skip",
+		logger: &Logger{service: "capstone", logger: log.New(io.Discard, "", 0)},
+		store:  store,
+		dlq:    newDeadLetterQueue(dlqPath),
+		clock:  realClock{},
+	}
+	r.skipJob(jobs[1], 1)
+	store.Close()
+
+	if _, err := os.Stat(dlqPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dead-letter file exists after a skip (stat err %v)", err)
+	}
+	state, _, err := replayWAL(walPath(dir, "run-skip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.finished[2] != statusSkipped {
+		t.Fatalf("wal status = %q, want skipped", state.finished[2])
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type deadLetter struct {
+	Run       string          `json:"run"`
+	Job       int             `json:"job"`
+	Kind      string          `json:"kind"`
+	Priority  int             `json:"priority"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	DependsOn []int           `json:"depends_on,omitempty"`
+	Attempts  int             `json:"attempts"`
+	Err       string          `json:"err"`
+	At        time.Time       `json:"at"`
+}
+
+type deadLetterQueue struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newDeadLetterQueue(path string) *deadLetterQueue {
+	return &deadLetterQueue{path: path}
+}
+
+func (q *deadLetterQueue) Add(letter deadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return fmt.Errorf("create dlq dir: %w", err)
+	}
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open dlq: %w", err)
+	}
+	defer f.Close()
+
+	letter.At = time.Now()
+	if err := json.NewEncoder(f).Encode(letter); err != nil {
+		return fmt.Errorf("append dlq: %w", err)
+	}
+	return f.Sync()
+}
+
+func (q *deadLetterQueue) Load() ([]deadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.load()
+}
+
+func (q *deadLetterQueue) load() ([]deadLetter, error) {
+	f, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open dlq: %w", err)
+	}
+	defer f.Close()
+
+	var letters []deadLetter
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var letter deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("parse dlq: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, sc.Err()
+}
+
+// Remove drops the letters for the given jobs and keeps the rest, including
+// any added since they were loaded. The file is replaced through a rename so
+// a crash leaves either the old or the new list.
+func (q *deadLetterQueue) Remove(done []deadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	drop := make(map[letterKey]bool, len(done))
+	for _, letter := range done {
+		drop[letter.key()] = true
+	}
+	letters, err := q.load()
+	if err != nil || len(letters) == 0 {
+		return err
+	}
+
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("rewrite dlq: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	for _, letter := range letters {
+		if drop[letter.key()] {
+			continue
+		}
+		if err := enc.Encode(letter); err != nil {
+			f.Close()
+			return fmt.Errorf("rewrite dlq: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("rewrite dlq: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("rewrite dlq: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("rewrite dlq: %w", err)
+	}
+	return nil
+}
+
+// letterKey names a dead job. IDs restart at 1 in every run, so the run is
+// part of it.
+type letterKey struct {
+	run string
+	job int
+}
+
+func (l deadLetter) key() letterKey {
+	return letterKey{run: l.Run, job: l.Job}
+}
+
+// replayJobs turns dead letters into jobs for a new run, one per dead job.
+// Each gets a fresh ID so jobs from different runs cannot collide; an edge
+// to another replayed job of the same run follows its new ID, and edges to
+// jobs that are not replayed are dropped. It also returns the letters the
+// jobs came from.
+func replayJobs(letters []deadLetter) ([]job, []deadLetter) {
+	ids := make(map[letterKey]int)
+	var jobs []job
+	var used []deadLetter
+	for _, letter := range letters {
+		if _, ok := ids[letter.key()]; ok {
+			continue
+		}
+		ids[letter.key()] = len(jobs) + 1
+		jobs = append(jobs, job{
+			ID:       len(jobs) + 1,
+			Kind:     letter.Kind,
+			Priority: letter.Priority,
+			Payload:  letter.Payload,
+		})
+		used = append(used, letter)
+	}
+	for i, letter := range used {
+		for _, dep := range letter.DependsOn {
+			if id, ok := ids[letterKey{run: letter.Run, job: dep}]; ok {
+				jobs[i].DependsOn = append(jobs[i].DependsOn, id)
+			}
+		}
+	}
+	return jobs, used
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeadLetterRoundTrip(t *testing.T) {
+	q := newDeadLetterQueue(filepath.Join(t.TempDir(), "dlq", "dead-letter.jsonl"))
+	if letters, err := q.Load(); err != nil || letters != nil {
+		t.Fatalf("Load of a missing file = %v, %v", letters, err)
+	}
+	for _, letter := range []deadLetter{
+		{Run: "a", Job: 1, Kind: "http", Attempts: 3, Err: "boom"},
+		{Run: "a", Job: 2, Kind: "hash", DependsOn: []int{1}},
+		{Run: "b", Job: 1, Kind: "http"},
+	} {
+		if err := q.Add(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := q.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 3 || loaded[0].Err != "boom" || loaded[1].DependsOn[0] != 1 || loaded[2].Run != "b" || loaded[0].At.IsZero() {
+		t.Fatalf("loaded = %+v", loaded)
+	}
+
+	// A letter added after the load survives removing the loaded ones.
+	if err := q.Add(deadLetter{Run: "c", Job: 1, Kind: "sim"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Remove(loaded[:2]); err != nil {
+		t.Fatal(err)
+	}
+	left, err := q.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0].key() != (letterKey{"b", 1}) || left[1].key() != (letterKey{"c", 1}) {
+		t.Fatalf("after remove = %+v", left)
+	}
+}
+
+func TestReplayKeepsJobsFromEveryRun(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.WALDir, cfg.DLQPath, cfg.ReplayDLQ = dir, filepath.Join(dir, "dead-letter.jsonl"), true
+	q := newDeadLetterQueue(cfg.DLQPath)
+	for _, letter := range []deadLetter{
+		{Run: "a", Job: 3, Kind: "http"},
+		{Run: "a", Job: 3, Kind: "http"},
+		{Run: "b", Job: 3, Kind: "hash"},
+		{Run: "b", Job: 5, Kind: "hash", DependsOn: []int{3, 4}},
+	} {
+		if err := q.Add(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runID, store, pending, err := openRun(cfg, defaultRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	want := []job{
+		{ID: 1, Kind: "http"},
+		{ID: 2, Kind: "hash"},
+		{ID: 3, Kind: "hash", DependsOn: []int{2}},
+	}
+	if !reflect.DeepEqual(pending, want) {
+		t.Fatalf("pending = %+v, want %+v", pending, want)
+	}
+	state, _, err := replayWAL(walPath(dir, runID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.enqueued) != 3 {
+		t.Fatalf("wal enqueued %d jobs, want 3", len(state.enqueued))
+	}
+	if left, err := q.Load(); err != nil || len(left) != 0 {
+		t.Fatalf("letters left after replay = %+v, %v", left, err)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Job interface {
+	Run(ctx context.Context, attempt int) error
+}
+
+type JobFunc func(ctx context.Context, attempt int) error
+
+func (f JobFunc) Run(ctx context.Context, attempt int) error {
+	return f(ctx, attempt)
+}
+
+type JobFactory func(id int, payload json.RawMessage) (Job, error)
+
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]JobFactory
+}
+
+type jobSpec struct {
+	ID        int             `json:"id"`
+	Kind      string          `json:"kind"`
+	Priority  json.RawMessage `json:"priority"`
+	Payload   json.RawMessage `json:"payload"`
+	DependsOn []int           `json:"depends_on"`
+}
+
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]JobFactory)}
+}
+
+func defaultRegistry() *Registry {
+	reg := NewRegistry()
+	reg.Register(defaultKind, newSimJob)
+	reg.Register("shell", newShellJob)
+	reg.Register("http", newHTTPJob)
+	reg.Register("hash", newHashJob)
+	reg.Register("checksum", newChecksumJob)
+	return reg
+}
+
+func (r *Registry) Register(kind string, factory JobFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[kind] = factory
+}
+
+func (r *Registry) Kinds() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	kinds := make([]string, 0, len(r.factories))
+	for kind := range r.factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func (r *Registry) Build(j job) (Job, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[j.Kind]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("job %d: unknown kind %q (registered: %s): %w", j.ID, j.Kind, strings.Join(r.Kinds(), ","), errJobFatal)
+	}
+	impl, err := factory(j.ID, j.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("job %d: %v: %w", j.ID, err, errJobFatal)
+	}
+	return impl, nil
+}
+
+func loadJobsFile(path string, reg *Registry) ([]job, error) {
+	jobs, err := readJobsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateDAG(jobs); err != nil {
+		return nil, fmt.Errorf("jobs file: %w", err)
+	}
+	for _, j := range jobs {
+		if _, err := reg.Build(j); err != nil {
+			return nil, fmt.Errorf("jobs file: %w", err)
+		}
+	}
+	return jobs, nil
+}
+
+func readJobsFile(path string) ([]job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open jobs file: %w", err)
+	}
+	defer f.Close()
+
+	var jobs []job
+	seen := make(map[int]bool)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := strings.TrimSpace(sc.Text())
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+
+		var spec jobSpec
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("jobs file line %d: %w", line, err)
+		}
+		j, err := spec.toJob(line)
+		if err != nil {
+			return nil, fmt.Errorf("jobs file line %d: %w", line, err)
+		}
+		if seen[j.ID] {
+			return nil, fmt.Errorf("jobs file line %d: duplicate id %d", line, j.ID)
+		}
+		seen[j.ID] = true
+		jobs = append(jobs, j)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read jobs file: %w", err)
+	}
+	if len(jobs) == 0 {
+		return nil, errors.New("jobs file has no jobs")
+	}
+	return jobs, nil
+}
+
+func (s jobSpec) toJob(line int) (job, error) {
+	j := job{ID: s.ID, Kind: s.Kind, Priority: priorityNormal, Payload: s.Payload, DependsOn: s.DependsOn}
+	if j.ID == 0 {
+		j.ID = line
+	}
+	if j.ID < 0 {
+		return job{}, fmt.Errorf("invalid id %d", j.ID)
+	}
+	if j.Kind == "" {
+		return job{}, errors.New("kind is required")
+	}
+	if len(s.Priority) > 0 {
+		p, err := parsePriority(strings.Trim(string(s.Priority), `"`))
+		if err != nil {
+			return job{}, err
+		}
+		j.Priority = p
+	}
+	return j, nil
+}
+
+func parsePriority(raw string) (int, error) {
+	for i, name := range priorityNames {
+		if raw == name {
+			return i, nil
+		}
+	}
+	p, err := strconv.Atoi(raw)
+	if err != nil || p < priorityLow || p > priorityHigh {
+		return 0, fmt.Errorf("invalid priority %q", raw)
+	}
+	return p, nil
+}
+
+func decodePayload(payload json.RawMessage, dst any) error {
+	if len(payload) == 0 {
+		return errors.New("payload is required")
+	}
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	return nil
+}
+
+func newSimJob(id int, _ json.RawMessage) (Job, error) {
+	return JobFunc(func(ctx context.Context, attempt int) error {
+		return processJob(ctx, id, attempt)
+	}), nil
+}
+
+type shellPayload struct {
+	Command string `json:"command"`
+}
+
+func newShellJob(id int, payload json.RawMessage) (Job, error) {
+	var p shellPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(p.Command) == "" {
+		return nil, errors.New("command is required")
+	}
+
+	return JobFunc(func(ctx context.Context, attempt int) error {
+		out, err := exec.CommandContext(ctx, "sh", "-c", p.Command).CombinedOutput()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				err = fmt.Errorf("%v: %s", err, msg)
+			}
+			return fmt.Errorf("job %d: shell %q: %v: %w", id, p.Command, err, errJobFailed)
+		}
+		return nil
+	}), nil
+}
+
+type httpPayload struct {
+	Method       string `json:"method"`
+	URL          string `json:"url"`
+	Body         string `json:"body"`
+	ExpectStatus int    `json:"expect_status"`
+	Timeout      string `json:"timeout"`
+}
+
+func newHTTPJob(id int, payload json.RawMessage) (Job, error) {
+	var p httpPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return nil, err
+	}
+	if p.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	if p.Method == "" {
+		p.Method = http.MethodGet
+	}
+	if p.ExpectStatus == 0 {
+		p.ExpectStatus = http.StatusOK
+	}
+	timeout := 5 * time.Second
+	if p.Timeout != "" {
+		d, err := time.ParseDuration(p.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", p.Timeout)
+		}
+		timeout = d
+	}
+	client := &http.Client{Timeout: timeout}
+
+	return JobFunc(func(ctx context.Context, attempt int) error {
+		req, err := http.NewRequestWithContext(ctx, p.Method, p.URL, strings.NewReader(p.Body))
+		if err != nil {
+			return fmt.Errorf("job %d: %v: %w", id, err, errJobFatal)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("job %d: %s %s: %v: %w", id, p.Method, p.URL, err, errJobFailed)
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+
+		switch {
+		case resp.StatusCode == p.ExpectStatus:
+			return nil
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("job %d: %s %s: status %d: %w", id, p.Method, p.URL, resp.StatusCode, errJobFailed)
+		default:
+			return fmt.Errorf("job %d: %s %s: status %d: %w", id, p.Method, p.URL, resp.StatusCode, errJobFatal)
+		}
+	}), nil
+}
+
+type hashPayload struct {
+	Path string `json:"path"`
+	Out  string `json:"out"`
+}
+
+func newHashJob(id int, payload json.RawMessage) (Job, error) {
+	var p hashPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return nil, err
+	}
+	if p.Path == "" {
+		return nil, errors.New("path is required")
+	}
+	if p.Out == "" {
+		p.Out = p.Path + ".sha256"
+	}
+
+	return JobFunc(func(ctx context.Context, attempt int) error {
+		sum, err := fileSHA256(ctx, p.Path)
+		if err != nil {
+			return fmt.Errorf("job %d: %w", id, err)
+		}
+		line := sum + "  " + p.Path + "\n"
+		if err := os.WriteFile(p.Out, []byte(line), 0o644); err != nil {
+			return fmt.Errorf("job %d: write %s: %v: %w", id, p.Out, err, errJobFailed)
+		}
+		return nil
+	}), nil
+}
+
+type checksumPayload struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+func newChecksumJob(id int, payload json.RawMessage) (Job, error) {
+	var p checksumPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return nil, err
+	}
+	if p.Path == "" || p.SHA256 == "" {
+		return nil, errors.New("path and sha256 are required")
+	}
+	want := strings.ToLower(p.SHA256)
+
+	return JobFunc(func(ctx context.Context, attempt int) error {
+		got, err := fileSHA256(ctx, p.Path)
+		if err != nil {
+			return fmt.Errorf("job %d: %w", id, err)
+		}
+		if got != want {
+			return fmt.Errorf("job %d: %s checksum %s, want %s: %w", id, p.Path, got, want, errJobFatal)
+		}
+		return nil
+	}), nil
+}
+
+func fileSHA256(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("open %s: %v: %w", path, err, errJobFatal)
+	}
+	if err != nil {
+		return "", fmt.Errorf("open %s: %v: %w", path, err, errJobFailed)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, ctxReader{ctx: ctx, r: f}); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("read %s: %v: %w", path, err, errJobFailed)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeJobsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jobs.jsonl")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadJobsFile(t *testing.T) {
+	path := writeJobsFile(t, "# nightly\n"+
+		`{"kind":"sim"}`+"\n"+
+		"\n"+
+		`{"id":10,"kind":"hash","priority":"high","payload":{"path":"a"}}`+"\n"+
+		`{"id":11,"kind":"sim","priority":0,"depends_on":[10]}`+"\n")
+	jobs, err := readJobsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []job{
+		{ID: 2, Kind: "sim", Priority: priorityNormal},
+		{ID: 10, Kind: "hash", Priority: priorityHigh, Payload: json.RawMessage(`{"path":"a"}`)},
+		{ID: 11, Kind: "sim", Priority: priorityLow, DependsOn: []int{10}},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Fatalf("jobs = %+v, want %+v", jobs, want)
+	}
+}
+
+func TestReadJobsFileRejects(t *testing.T) {
+	cases := []struct {
+		name, content, want string
+	}{
+		{"malformed", `{"kind":"sim"` + "\n", "line 1"},
+		{"unknown field", `{"kind":"sim","retries":3}` + "\n", "unknown field"},
+		{"duplicate id", `{"id":1,"kind":"sim"}` + "\n" + `{"id":1,"kind":"sim"}` + "\n", "line 2: duplicate id 1"},
+		{"line id clash", `{"id":2,"kind":"sim"}` + "\n" + `{"kind":"sim"}` + "\n", "duplicate id 2"},
+		{"negative id", `{"id":-4,"kind":"sim"}` + "\n", "invalid id"},
+		{"no kind", `{"id":1}` + "\n", "kind is required"},
+		{"bad priority", `{"kind":"sim","priority":"urgent"}` + "\n", "invalid priority"},
+		{"empty", "# nothing yet\n", "no jobs"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readJobsFile(writeJobsFile(t, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadJobsFileUnknownKind(t *testing.T) {
+	path := writeJobsFile(t, `{"id":1,"kind":"sim"}`+"\n"+`{"id":2,"kind":"ftp"}`+"\n")
+	_, err := loadJobsFile(path, defaultRegistry())
+	if !errors.Is(err, errJobFatal) || !strings.Contains(err.Error(), `unknown kind "ftp"`) {
+		t.Fatalf("err = %v, want a fatal unknown kind", err)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want int
+		ok   bool
+	}{
+		{"low", priorityLow, true},
+		{"normal", priorityNormal, true},
+		{"high", priorityHigh, true},
+		{"0", priorityLow, true},
+		{"2", priorityHigh, true},
+		{"3", 0, false},
+		{"-1", 0, false},
+		{"HIGH", 0, false},
+		{"", 0, false},
+	}
+	for _, tc := range cases {
+		got, err := parsePriority(tc.raw)
+		if (err == nil) != tc.ok || (tc.ok && got != tc.want) {
+			t.Errorf("parsePriority(%q) = %d, %v", tc.raw, got, err)
+		}
+	}
+}
+
+func TestRegistryBuildRejectsBadPayloads(t *testing.T) {
+	reg := defaultRegistry()
+	cases := []job{
+		{ID: 1, Kind: "ftp"},
+		{ID: 2, Kind: "shell"},
+		{ID: 3, Kind: "shell", Payload: json.RawMessage(`{"command":"  "}`)},
+		{ID: 4, Kind: "http", Payload: json.RawMessage(`{"method":"GET"}`)},
+		{ID: 5, Kind: "http", Payload: json.RawMessage(`{"url":"http://x","timeout":"-1s"}`)},
+		{ID: 6, Kind: "hash", Payload: json.RawMessage(`{"out":"x"}`)},
+		{ID: 7, Kind: "checksum", Payload: json.RawMessage(`{"path":"x"}`)},
+		{ID: 8, Kind: "hash", Payload: json.RawMessage(`{"path":"x","mode":"fast"}`)},
+	}
+	for _, j := range cases {
+		if _, err := reg.Build(j); !errors.Is(err, errJobFatal) {
+			t.Errorf("Build(%s %s) = %v, want a fatal error", j.Kind, j.Payload, err)
+		}
+	}
+	if _, err := reg.Build(job{ID: 9, Kind: defaultKind}); err != nil {
+		t.Errorf("Build(sim) = %v", err)
+	}
+}
+
+func TestJobKinds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(data, []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const helloSum = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+	cases := []struct {
+		name    string
+		kind    string
+		payload string
+		want    error
+	}{
+		{"shell ok", "shell", `{"command":"true"}`, nil},
+		{"shell fails", "shell", `{"command":"echo nope >&2; exit 3"}`, errJobFailed},
+		{"http ok", "http", `{"url":"` + srv.URL + `/"}`, nil},
+		{"http expect", "http", `{"method":"POST","url":"` + srv.URL + `/created","expect_status":201}`, nil},
+		{"http 503 retries", "http", `{"url":"` + srv.URL + `/busy"}`, errJobFailed},
+		{"http 404 is fatal", "http", `{"url":"` + srv.URL + `/missing"}`, errJobFatal},
+		{"hash", "hash", `{"path":"` + data + `"}`, nil},
+		{"hash missing file", "hash", `{"path":"` + filepath.Join(dir, "gone") + `"}`, errJobFatal},
+		{"checksum ok", "checksum", `{"path":"` + data + `","sha256":"` + strings.ToUpper(helloSum) + `"}`, nil},
+		{"checksum mismatch", "checksum", `{"path":"` + data + `","sha256":"00"}`, errJobFatal},
+	}
+	reg := defaultRegistry()
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			impl, err := reg.Build(job{ID: i + 1, Kind: tc.kind, Payload: json.RawMessage(tc.payload)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = impl.Run(context.Background(), 1)
+			if tc.want == nil && err != nil || tc.want != nil && !errors.Is(err, tc.want) {
+				t.Fatalf("Run = %v, want %v", err, tc.want)
+			}
+		})
+	}
+
+	got, err := os.ReadFile(data + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := helloSum + "  " + data + "\n"; string(got) != want {
+		t.Fatalf("hash output = %q, want %q", got, want)
+	}
+}
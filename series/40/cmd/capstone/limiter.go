@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+type kindRates map[string]RateLimit
+
+type kindCaps map[string]int
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// limiter gates dispatch per job kind with a token bucket and a cap on jobs
+// in flight. It is only touched by the run loop, so it needs no locking.
+type limiter struct {
+	buckets  map[string]*tokenBucket
+	caps     kindCaps
+	inflight map[string]int
+	starved  map[string]time.Time
+}
+
+func newLimiter(rates kindRates, caps kindCaps, now time.Time) *limiter {
+	l := &limiter{
+		buckets:  make(map[string]*tokenBucket, len(rates)),
+		caps:     caps,
+		inflight: make(map[string]int),
+		starved:  make(map[string]time.Time),
+	}
+	for kind, limit := range rates {
+		l.buckets[kind] = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+	}
+	return l
+}
+
+// allow reports whether a job of kind may be dispatched now. A kind refused
+// for lack of tokens starts its token wait here.
+func (l *limiter) allow(kind string, now time.Time) bool {
+	if limit, ok := l.caps[kind]; ok && l.inflight[kind] >= limit {
+		return false
+	}
+	b, ok := l.buckets[kind]
+	if !ok {
+		return true
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return true
+	}
+	if _, ok := l.starved[kind]; !ok {
+		l.starved[kind] = now
+	}
+	return false
+}
+
+// waited reports how long kind has been refused for lack of tokens.
+func (l *limiter) waited(kind string, now time.Time) time.Duration {
+	if since, ok := l.starved[kind]; ok {
+		return now.Sub(since)
+	}
+	return 0
+}
+
+// take spends a token and a concurrency slot for a dispatched job.
+func (l *limiter) take(kind string, now time.Time) {
+	l.inflight[kind]++
+	if b, ok := l.buckets[kind]; ok {
+		b.refill(now)
+		b.tokens--
+	}
+	delete(l.starved, kind)
+}
+
+func (l *limiter) release(kind string) {
+	if l.inflight[kind] > 0 {
+		l.inflight[kind]--
+	}
+}
+
+// nextToken returns when the earliest token-starved kind gets its next
+// token. Kinds that already have one are waiting on their cap instead.
+func (l *limiter) nextToken(now time.Time) (time.Time, bool) {
+	var next time.Time
+	for kind := range l.starved {
+		b := l.buckets[kind]
+		b.refill(now)
+		wait := b.untilToken()
+		if wait <= 0 {
+			continue
+		}
+		if at := now.Add(wait); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed.Seconds()*b.limit.PerSecond)
+		b.last = now
+	}
+}
+
+func (b *tokenBucket) untilToken() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.limit.PerSecond * float64(time.Second)))
+}
+
+func (r kindRates) String() string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		limit := r[name]
+		parts = append(parts, name+"="+formatFloat(limit.PerSecond)+"/s:"+strconv.Itoa(limit.Burst))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses kind=rate/unit[:burst] pairs, e.g. http=5/s:10,hash=30/m.
+func (r kindRates) Set(raw string) error {
+	for k := range r {
+		delete(r, k)
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid kind rate %q", part)
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return fmt.Errorf("kind %q: %w", name, err)
+		}
+		r[name] = limit
+	}
+	return nil
+}
+
+func parseRateLimit(raw string) (RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(raw, ":")
+	count, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate %q, want n/s, n/m or n/h", raw)
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q", raw)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate unit %q", unit)
+	}
+	limit := RateLimit{PerSecond: n / per.Seconds(), Burst: 1}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("invalid burst %q", burst)
+		}
+	}
+	return limit, nil
+}
+
+func (c kindCaps) String() string {
+	return kindWeights(c).String()
+}
+
+func (c kindCaps) Set(raw string) error {
+	for k := range c {
+		delete(c, k)
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid kind cap %q", part)
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("invalid max in-flight for kind %q", name)
+		}
+		c[name] = limit
+	}
+	return nil
+}
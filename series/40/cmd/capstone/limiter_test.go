@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterTokenBucket(t *testing.T) {
+	now := simEpoch
+	l := newLimiter(kindRates{"http": {PerSecond: 2, Burst: 2}}, nil, now)
+
+	for i := 0; i < 2; i++ {
+		if !l.allow("http", now) {
+			t.Fatalf("burst token %d refused", i+1)
+		}
+		l.take("http", now)
+	}
+	if l.allow("http", now) {
+		t.Fatal("allowed past the burst")
+	}
+	at, ok := l.nextToken(now)
+	if !ok || at.Sub(now) != 500*time.Millisecond {
+		t.Fatalf("next token in %v, want 500ms", at.Sub(now))
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("http", now) {
+		t.Fatal("token not refilled after 500ms")
+	}
+	if got := l.waited("http", now); got != 500*time.Millisecond {
+		t.Fatalf("waited = %v, want 500ms", got)
+	}
+	l.take("http", now)
+	if got := l.waited("http", now); got != 0 {
+		t.Fatalf("waited after take = %v, want 0", got)
+	}
+	if !l.allow("sim", now) {
+		t.Fatal("unlimited kind refused")
+	}
+}
+
+func TestLimiterInFlightCap(t *testing.T) {
+	l := newLimiter(nil, kindCaps{"shell": 1}, simEpoch)
+	l.take("shell", simEpoch)
+	if l.allow("shell", simEpoch) {
+		t.Fatal("allowed past the cap")
+	}
+	if _, ok := l.nextToken(simEpoch); ok {
+		t.Fatal("a capped kind should wait on results, not tokens")
+	}
+	l.release("shell")
+	if !l.allow("shell", simEpoch) {
+		t.Fatal("refused after release")
+	}
+}
+
+func TestSchedulerSkipsRefusedKinds(t *testing.T) {
+	s := newScheduler(nil)
+	s.push(job{ID: 1, Kind: "http", Priority: priorityHigh})
+	s.push(job{ID: 2, Kind: "sim", Priority: priorityLow})
+	s.allow = func(kind string) bool { return kind != "http" }
+
+	got, ok := s.pop()
+	if !ok || got.ID != 2 {
+		t.Fatalf("pop = %d, %v, want 2 while http is throttled", got.ID, ok)
+	}
+	if _, ok := s.peek(); ok {
+		t.Fatal("expected only the throttled job left")
+	}
+	if s.len() != 1 {
+		t.Fatalf("len = %d, want 1", s.len())
+	}
+}
+
+func TestSchedulerTakesPeekedJobAfterRefill(t *testing.T) {
+	now := simEpoch
+	l := newLimiter(kindRates{"http": {PerSecond: 1, Burst: 1}}, nil, now)
+	l.take("http", now)
+	s := newScheduler(nil)
+	s.allow = func(kind string) bool { return l.allow(kind, now) }
+	s.push(job{ID: 1, Kind: "http", Priority: priorityHigh})
+	s.push(job{ID: 2, Kind: "sim", Priority: priorityLow})
+
+	next, ok := s.peek()
+	if !ok || next.ID != 2 {
+		t.Fatalf("peek = %d, %v, want 2 while http is throttled", next.ID, ok)
+	}
+	// http gets its token back while job 2 is being handed to a worker.
+	now = now.Add(time.Second)
+	if !s.take(next) {
+		t.Fatal("take refused the peeked job")
+	}
+	got, ok := s.pop()
+	if !ok || got.ID != 1 {
+		t.Fatalf("pop = %d, %v, want the http job still queued", got.ID, ok)
+	}
+	if s.len() != 0 {
+		t.Fatalf("len = %d, want 0", s.len())
+	}
+}
+
+func TestParseKindRates(t *testing.T) {
+	r := kindRates{}
+	if err := r.Set("http=5/s:10,hash=30/m"); err != nil {
+		t.Fatal(err)
+	}
+	if r["http"] != (RateLimit{PerSecond: 5, Burst: 10}) || r["hash"] != (RateLimit{PerSecond: 0.5, Burst: 1}) {
+		t.Fatalf("rates = %v", r)
+	}
+	for _, raw := range []string{"http", "http=5", "http=0/s", "http=5/d", "http=5/s:0"} {
+		if err := (kindRates{}).Set(raw); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", raw)
+		}
+	}
+}
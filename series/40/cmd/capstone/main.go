@@ -6,7 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,29 +18,65 @@ import (
 
 var errJobFailed = errors.New("job failed")
 
+const (
+	stateRunning     = "running"
+	stateDone        = "done"
+	stateTimeout     = "timeout"
+	stateCanceled    = "canceled"
+	stateInterrupted = "interrupted"
+)
+
 type Config struct {
-	Jobs    int
-	Workers int
-	Timeout time.Duration
+	Jobs        int
+	Workers     int
+	Timeout     time.Duration
+	WALDir      string
+	Resume      string
+	Retry       RetryPolicy
+	DLQPath     string
+	ReplayDLQ   bool
+	KindWeights kindWeights
+	KindRates   kindRates
+	KindCaps    kindCaps
+	JobsFile    string
+	ReportPath  string
+	Drain       time.Duration
+	Autoscale   AutoscalePolicy
+	Lease       time.Duration
+	TracePath   string
+	Simulate    bool
+	Seed        uint64
 }
 
 type Summary struct {
-	Jobs     int
-	Handled  int
-	Failed   int
-	Canceled int
-	Elapsed  time.Duration
+	Status       string
+	Jobs         int
+	Handled      int
+	Failed       int
+	Canceled     int
+	Retried      int
+	DeadLettered int
+	Skipped      int
+	Reassigned   int
+	Elapsed      time.Duration
+	Waits        map[string]WaitStats
+	TokenWaits   map[string]WaitStats
+	Stats        *runStats
 }
 
 type result struct {
-	id   int
-	err  error
-	cost time.Duration
+	job          job
+	worker       int
+	err          error
+	cost         time.Duration
+	attempts     int
+	deadLettered bool
 }
 
 type Logger struct {
 	service string
 	logger  *log.Logger
+	clock   Clock
 }
 
 type Field struct {
@@ -45,52 +84,307 @@ type Field struct {
 	Value string
 }
 
+type runner struct {
+	cfg      Config
+	logger   *Logger
+	runID    string
+	store    *jobStore
+	dlq      *deadLetterQueue
+	registry *Registry
+	progress *progress
+	stop     <-chan struct{}
+	clock    Clock
+}
+
 func main() {
-	cfg := parseFlags()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serveMain(os.Args[2:])
+			return
+		case "coordinator":
+			coordinatorMain(os.Args[2:])
+			return
+		case "worker":
+			workerMain(os.Args[2:])
+			return
+		case "cron":
+			cronMain(os.Args[2:])
+			return
+		}
+	}
+
+	cfg := parseFlags(os.Args[1:])
+	logger := NewLogger("capstone")
+	var clock Clock = realClock{}
+	if cfg.Simulate {
+		// A simulation keeps its WAL and dead letters out of the real ones.
+		dir, err := os.MkdirTemp("", "capstone-sim-")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cfg.WALDir, cfg.DLQPath = dir, filepath.Join(dir, "dead-letter.jsonl")
+		clock = newSimClock(simEpoch)
+		logger = newClockLogger("capstone", clock)
+	}
 	if err := validateConfig(cfg); err != nil {
 		log.Fatal(err)
 	}
 
-	logger := NewLogger("capstone")
-	runID := traceID()
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	registry := defaultRegistry()
+	runID, store, pending, err := openRun(cfg, registry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx, cancel := clock.WithTimeout(context.Background(), cfg.Timeout)
 	defer cancel()
 
+	finished := make(chan struct{})
+	sig := watchSignals(logger, runID, cfg.Drain, cancel, finished)
+
+	tracer := NewTracer("capstone")
+	if cfg.Simulate {
+		tracer.clock, tracer.traceID = clock, fmt.Sprintf("%032x", cfg.Seed)
+	}
+	ctx, root := tracer.Start(ctx, "run",
+		Str("run", runID),
+		Int("jobs", len(pending)),
+		Int("workers", cfg.Workers),
+	)
+
 	logger.Info("run start",
 		Str("run", runID),
-		Int("jobs", cfg.Jobs),
+		Str("trace", tracer.TraceID()),
+		Int("jobs", len(pending)),
 		Int("workers", cfg.Workers),
 		Duration("timeout", cfg.Timeout),
+		Int("max_attempts", cfg.Retry.MaxAttempts),
+		Str("resume", strconv.FormatBool(cfg.Resume != "")),
+		Str("replay_dlq", strconv.FormatBool(cfg.ReplayDLQ)),
 	)
 
-	summary := run(ctx, cfg, logger, runID)
+	r := &runner{
+		cfg:      cfg,
+		logger:   logger,
+		runID:    runID,
+		store:    store,
+		dlq:      newDeadLetterQueue(cfg.DLQPath),
+		registry: registry,
+		stop:     sig.stop,
+		clock:    clock,
+	}
+	summary := r.run(ctx, pending)
+	close(finished)
+	summary.Status = runStatus(ctx, sig.interrupted())
+	endRunSpan(root, summary)
 
 	logger.Info("run summary",
 		Str("run", runID),
+		Str("status", summary.Status),
 		Int("handled", summary.Handled),
 		Int("failed", summary.Failed),
 		Int("canceled", summary.Canceled),
+		Int("retried", summary.Retried),
+		Int("dead_lettered", summary.DeadLettered),
+		Int("skipped", summary.Skipped),
+		Int("pending", summary.Jobs-summary.Handled-summary.Skipped+summary.Canceled),
 		Duration("cost", summary.Elapsed),
 	)
+	logWaits(logger, runID, summary)
+	logReport(logger, cfg, newReport(runID, summary))
+	if cfg.TracePath != "" {
+		if err := tracer.WriteFile(cfg.TracePath); err != nil {
+			logger.Error("trace write failed", Str("run", runID), Err(err))
+		} else {
+			logger.Info("trace written", Str("run", runID), Str("trace", tracer.TraceID()), Str("file", cfg.TracePath))
+		}
+	}
+}
+
+func endRunSpan(span *Span, summary Summary) {
+	span.SetAttr(
+		Str("status", summary.Status),
+		Int("handled", summary.Handled),
+		Int("failed", summary.Failed),
+		Int("canceled", summary.Canceled),
+		Int("skipped", summary.Skipped),
+	)
+	var err error
+	if summary.Status != stateDone {
+		err = fmt.Errorf("run %s", summary.Status)
+	}
+	span.End(err)
+}
+
+func logReport(logger *Logger, cfg Config, rep Report) {
+	logger.Info("run latency",
+		Str("run", rep.Run),
+		Int("jobs", rep.Latency.Count),
+		Str("p50_ms", formatFloat(rep.Latency.P50MS)),
+		Str("p90_ms", formatFloat(rep.Latency.P90MS)),
+		Str("p99_ms", formatFloat(rep.Latency.P99MS)),
+		Str("max_ms", formatFloat(rep.Latency.MaxMS)),
+	)
+	if cfg.ReportPath == "" {
+		return
+	}
+	paths, err := writeReport(cfg.ReportPath, rep)
+	if err != nil {
+		logger.Error("report write failed", Str("run", rep.Run), Err(err))
+		return
+	}
+	logger.Info("report written", Str("run", rep.Run), Str("files", strings.Join(paths, ",")))
+}
+
+func logWaits(logger *Logger, runID string, summary Summary) {
+	for p := priorityHigh; p >= priorityLow; p-- {
+		w, ok := summary.Waits[priorityName(p)]
+		if !ok {
+			continue
+		}
+		logger.Info("priority wait",
+			Str("run", runID),
+			Str("priority", priorityName(p)),
+			Int("jobs", w.Jobs),
+			Duration("avg", w.Avg()),
+			Duration("max", w.Max),
+		)
+	}
+	kinds := make([]string, 0, len(summary.TokenWaits))
+	for kind := range summary.TokenWaits {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		w := summary.TokenWaits[kind]
+		logger.Info("token wait",
+			Str("run", runID),
+			Str("kind", kind),
+			Int("jobs", w.Jobs),
+			Duration("total", w.Total),
+			Duration("max", w.Max),
+		)
+	}
 }
 
-func parseFlags() Config {
-	cfg := Config{
-		Jobs:    9,
-		Workers: 3,
-		Timeout: 500 * time.Millisecond,
+func openRun(cfg Config, registry *Registry) (string, *jobStore, []job, error) {
+	if cfg.Resume != "" {
+		store, state, err := openJobStore(cfg.WALDir, cfg.Resume)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return cfg.Resume, store, state.unfinished(), nil
+	}
+
+	var pending []job
+	var replayed []deadLetter
+	if cfg.ReplayDLQ {
+		letters, err := newDeadLetterQueue(cfg.DLQPath).Load()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		pending, replayed = replayJobs(letters)
+	} else if cfg.JobsFile != "" {
+		jobs, err := loadJobsFile(cfg.JobsFile, registry)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		pending = jobs
+	} else {
+		pending = generateJobs(cfg.Jobs)
+	}
+
+	runID := traceID()
+	if cfg.Simulate {
+		runID = fmt.Sprintf("sim-%d", cfg.Seed)
+	}
+	store, err := createJobStore(cfg.WALDir, runID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	store.noSync = cfg.Simulate
+	if err := store.Begin(pending); err != nil {
+		store.Close()
+		return "", nil, nil, err
 	}
+	// The replayed jobs are now owned by this run's WAL, so their letters can
+	// go. Letters added since the load stay for a later replay.
+	if cfg.ReplayDLQ {
+		if err := newDeadLetterQueue(cfg.DLQPath).Remove(replayed); err != nil {
+			store.Close()
+			return "", nil, nil, err
+		}
+	}
+	return runID, store, pending, nil
+}
 
-	flag.IntVar(&cfg.Jobs, "jobs", cfg.Jobs, "number of jobs")
-	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "number of workers")
-	flag.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "run timeout")
-	flag.Parse()
+func defaultConfig() Config {
+	return Config{
+		Jobs:      9,
+		Workers:   3,
+		Timeout:   500 * time.Millisecond,
+		WALDir:    filepath.Join("series", "40", "tmp", "wal"),
+		Retry:     defaultRetryPolicy(),
+		Drain:     2 * time.Second,
+		Autoscale: defaultAutoscalePolicy(),
+		Lease:     2 * time.Second,
+		DLQPath:   filepath.Join("series", "40", "tmp", "dead-letter.jsonl"),
+		Seed:      1,
+		KindWeights: kindWeights{
+			defaultKind: 1,
+		},
+		KindRates: kindRates{},
+		KindCaps:  kindCaps{},
+	}
+}
 
+func parseFlags(args []string) Config {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("capstone", flag.ExitOnError)
+	registerFlags(fs, &cfg)
+	registerAutoscaleFlags(fs, &cfg)
+	// Only a local run builds a tracer, and only main sets up the temporary
+	// WAL and virtual clock a simulation needs.
+	fs.StringVar(&cfg.TracePath, "trace", cfg.TracePath, "write run, job and attempt spans to this file as OTLP JSON")
+	fs.BoolVar(&cfg.Simulate, "simulate", cfg.Simulate, "run generated jobs on a virtual clock; same flags and seed give the same summary")
+	fs.Uint64Var(&cfg.Seed, "seed", cfg.Seed, "seed for retry jitter in -simulate")
+	_ = fs.Parse(args)
 	return cfg
 }
 
+// registerFlags adds the flags every subcommand that runs jobs honours. The
+// register*Flags helpers below add the ones only some of them support, so a
+// subcommand does not accept a flag it would ignore.
+func registerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.Jobs, "jobs", cfg.Jobs, "number of jobs")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "number of workers")
+	fs.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "run timeout")
+	fs.StringVar(&cfg.WALDir, "wal-dir", cfg.WALDir, "directory for run write-ahead logs")
+	fs.StringVar(&cfg.Resume, "resume", cfg.Resume, "resume unfinished jobs of a previous run ID")
+	fs.IntVar(&cfg.Retry.MaxAttempts, "max-attempts", cfg.Retry.MaxAttempts, "attempts per job before dead-lettering")
+	fs.DurationVar(&cfg.Retry.BaseDelay, "backoff", cfg.Retry.BaseDelay, "base retry backoff")
+	fs.DurationVar(&cfg.Retry.MaxDelay, "max-backoff", cfg.Retry.MaxDelay, "max retry backoff")
+	fs.StringVar(&cfg.DLQPath, "dlq", cfg.DLQPath, "dead-letter file")
+	fs.BoolVar(&cfg.ReplayDLQ, "replay-dlq", cfg.ReplayDLQ, "run the jobs in the dead-letter file")
+	fs.StringVar(&cfg.JobsFile, "jobs-file", cfg.JobsFile, "JSON lines file describing jobs (kind, priority, payload)")
+	fs.DurationVar(&cfg.Drain, "drain", cfg.Drain, "time in-flight jobs get to finish after SIGINT/SIGTERM")
+	fs.StringVar(&cfg.ReportPath, "report", cfg.ReportPath, "write the run report to <path>.json and <path>.csv")
+	fs.Var(cfg.KindWeights, "kind-weights", "fair-share weights per job kind, e.g. import=3,export=1")
+	fs.Var(cfg.KindRates, "kind-rate", "token-bucket rate per job kind as rate/unit[:burst], e.g. http=5/s:10,hash=30/m")
+	fs.Var(cfg.KindCaps, "kind-max-inflight", "max jobs in flight per job kind, e.g. http=2")
+}
+
+// registerAutoscaleFlags is for subcommands whose workers run in process.
+func registerAutoscaleFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.Autoscale.MinWorkers, "min-workers", cfg.Autoscale.MinWorkers, "autoscaler lower bound (with -max-workers)")
+	fs.IntVar(&cfg.Autoscale.MaxWorkers, "max-workers", cfg.Autoscale.MaxWorkers, "autoscaler upper bound; 0 keeps -workers fixed")
+}
+
 func validateConfig(cfg Config) error {
-	if cfg.Jobs <= 0 {
+	if cfg.Jobs <= 0 && cfg.Resume == "" && !cfg.ReplayDLQ && cfg.JobsFile == "" {
 		return errors.New("jobs must be positive")
 	}
 	if cfg.Workers <= 0 {
@@ -99,91 +393,417 @@ func validateConfig(cfg Config) error {
 	if cfg.Timeout <= 0 {
 		return errors.New("timeout must be positive")
 	}
+	if cfg.WALDir == "" {
+		return errors.New("wal-dir is required")
+	}
+	if cfg.Resume != "" && cfg.ReplayDLQ {
+		return errors.New("resume and replay-dlq are mutually exclusive")
+	}
+	if cfg.JobsFile != "" && (cfg.Resume != "" || cfg.ReplayDLQ) {
+		return errors.New("jobs-file cannot be combined with resume or replay-dlq")
+	}
+	if cfg.Retry.MaxAttempts <= 0 {
+		return errors.New("max-attempts must be positive")
+	}
+	if cfg.Retry.BaseDelay <= 0 || cfg.Retry.MaxDelay < cfg.Retry.BaseDelay {
+		return errors.New("backoff must be positive and not exceed max-backoff")
+	}
+	if err := cfg.Autoscale.validate(cfg.Workers); err != nil {
+		return err
+	}
+	if cfg.Drain < 0 {
+		return errors.New("drain must not be negative")
+	}
+	if cfg.DLQPath == "" {
+		return errors.New("dlq is required")
+	}
+	if cfg.Simulate && (cfg.Resume != "" || cfg.ReplayDLQ || cfg.JobsFile != "") {
+		return errors.New("simulate runs generated jobs only; drop resume, replay-dlq and jobs-file")
+	}
+	if cfg.Simulate && cfg.Autoscale.enabled() {
+		return errors.New("simulate cannot be combined with the autoscaler")
+	}
+	if cfg.JobsFile != "" {
+		jobs, err := readJobsFile(cfg.JobsFile)
+		if err != nil {
+			return err
+		}
+		if err := validateDAG(jobs); err != nil {
+			return fmt.Errorf("jobs file: %w", err)
+		}
+	}
 	return nil
 }
 
-func run(ctx context.Context, cfg Config, logger *Logger, runID string) Summary {
-	start := time.Now()
-	jobs := make(chan int)
+func (r *runner) run(ctx context.Context, pending []job) Summary {
+	ctx = withClock(ctx, r.clock)
+	start := r.clock.Now()
+	jobs := make(chan job)
+	retire := make(chan struct{})
 	results := make(chan result)
 
+	summary := Summary{
+		Jobs:       len(pending),
+		Waits:      make(map[string]WaitStats),
+		TokenWaits: make(map[string]WaitStats),
+		Stats:      newRunStats(start),
+	}
+
 	var wg sync.WaitGroup
-	for i := 1; i <= cfg.Workers; i++ {
+	workers, lastWorker := 0, 0
+	spawn := func() {
+		workers++
+		lastWorker++
+		summary.Stats.addWorker(lastWorker)
 		wg.Add(1)
-		go worker(ctx, i, jobs, results, logger, runID, &wg)
+		go r.worker(ctx, lastWorker, jobs, retire, results, &wg)
+	}
+	for i := 0; i < r.cfg.Workers; i++ {
+		spawn()
 	}
 
-	go func() {
-		defer close(jobs)
-		for i := 1; i <= cfg.Jobs; i++ {
-			select {
-			case <-ctx.Done():
-				return
-			case jobs <- i:
-			}
+	var scaler *autoscaler
+	var ticks <-chan time.Time
+	if r.cfg.Autoscale.enabled() {
+		scaler = newAutoscaler(r.cfg.Autoscale, r.clock)
+		ticker := r.clock.NewTicker(r.cfg.Autoscale.Interval)
+		defer ticker.Stop()
+		ticks = ticker.C()
+	}
+
+	queue := newScheduler(r.cfg.KindWeights)
+	limits := newLimiter(r.cfg.KindRates, r.cfg.KindCaps, start)
+	queue.allow = func(kind string) bool { return limits.allow(kind, r.clock.Now()) }
+	graph, ready := newDAG(pending)
+	for _, j := range ready {
+		j.enqueuedAt = start
+		queue.push(j)
+	}
+
+	// refill wakes the loop when a kind held back by its rate limit gets a
+	// token; a result wakes it for kinds held back by their cap.
+	var refill Ticker
+	var refillAt time.Time
+	defer func() {
+		if refill != nil {
+			refill.Stop()
 		}
 	}()
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	sim, _ := r.clock.(*simClock)
+	var wake <-chan struct{}
+	if sim != nil {
+		wake = sim.wake
+	}
+
+	done, stop := ctx.Done(), r.stop
+	dispatching := true
+	inflight := 0
+	for inflight > 0 || (dispatching && queue.len() > 0) {
+		now := r.clock.Now()
+		next, ok := queue.peek()
+		at, starved := limits.nextToken(now)
+		if refill != nil && (ok || !starved || !at.Equal(refillAt)) {
+			refill.Stop()
+			refill = nil
+		}
+		if refill == nil && !ok && starved && dispatching {
+			refill, refillAt = r.clock.NewTicker(at.Sub(now)), at
+		}
+
+		// On the virtual clock, move time forward only once nothing else can
+		// happen at the current instant.
+		if sim != nil && ctx.Err() == nil {
+			canDispatch := dispatching && ok && workers > inflight
+			if !canDispatch && sim.sleepers() == inflight && sim.advance() {
+				continue
+			}
+		}
 
-	summary := Summary{Jobs: cfg.Jobs}
-	for res := range results {
-		summary.Handled++
-		if res.err != nil {
-			if errors.Is(res.err, context.DeadlineExceeded) || errors.Is(res.err, context.Canceled) {
-				summary.Canceled++
-			} else {
-				summary.Failed++
+		var out chan<- job
+		if ok && dispatching {
+			out = jobs
+			next.tokenWait = limits.waited(next.Kind, now)
+		}
+		var refilled <-chan time.Time
+		if refill != nil {
+			refilled = refill.C()
+		}
+
+		select {
+		case out <- next.job:
+			queue.take(next)
+			now := r.clock.Now()
+			limits.take(next.Kind, now)
+			inflight++
+			summary.addWait(next.job, now.Sub(next.enqueuedAt))
+			summary.addTokenWait(next.job)
+		case <-refilled:
+		case res := <-results:
+			inflight--
+			limits.release(res.job.Kind)
+			now := r.clock.Now()
+			for _, j := range r.settle(&summary, graph, res, now) {
+				j.enqueuedAt = now
+				queue.push(j)
+			}
+		case <-ticks:
+			in := scaleInput{workers: workers, busy: inflight, queued: queue.len()}
+			if oldest, ok := queue.oldest(); ok {
+				in.oldestWait = r.clock.Now().Sub(oldest)
+			}
+			delta, reason := scaler.observe(in)
+			switch {
+			case delta > 0 && dispatching:
+				spawn()
+				r.logScale("workers scaled up", reason, workers, in)
+			case delta < 0:
+				select {
+				case retire <- struct{}{}:
+					workers--
+					r.logScale("workers scaled down", reason, workers, in)
+				default:
+				}
 			}
+		case <-wake:
+		case <-done:
+			dispatching, done, stop = false, nil, nil
+		case <-stop:
+			dispatching, done, stop = false, nil, nil
 		}
 	}
-	summary.Elapsed = time.Since(start)
+	close(jobs)
+	wg.Wait()
+
+	if n := graph.waiting(); n > 0 {
+		r.logger.Info("jobs left waiting on dependencies", Str("run", r.runID), Int("jobs", n))
+	}
+	summary.Elapsed = r.clock.Now().Sub(start)
 	return summary
 }
 
-func worker(ctx context.Context, id int, jobs <-chan int, results chan<- result, logger *Logger, runID string, wg *sync.WaitGroup) {
+// settle folds a finished job into the summary and returns the jobs whose
+// dependencies it completed.
+func (r *runner) settle(summary *Summary, graph *dag, res result, now time.Time) []job {
+	var ready []job
+	switch {
+	case res.err == nil:
+		ready = graph.complete(res.job.ID)
+	case !isCanceled(res.err):
+		for _, j := range graph.skip(res.job.ID) {
+			r.skipJob(j, res.job.ID)
+			summary.Skipped++
+		}
+	}
+	summary.Stats.record(res, now)
+	summary.Handled++
+	summary.Retried += res.attempts - 1
+	if res.deadLettered {
+		summary.DeadLettered++
+	}
+	if res.err != nil {
+		if isCanceled(res.err) {
+			summary.Canceled++
+		} else {
+			summary.Failed++
+		}
+	}
+	if r.progress != nil {
+		r.progress.set(*summary)
+	}
+	return ready
+}
+
+func (s *Summary) addWait(j job, d time.Duration) {
+	class := priorityName(j.Priority)
+	w := s.Waits[class]
+	w.add(d)
+	s.Waits[class] = w
+}
+
+func (s *Summary) addTokenWait(j job) {
+	if j.tokenWait <= 0 {
+		return
+	}
+	w := s.TokenWaits[j.Kind]
+	w.add(j.tokenWait)
+	s.TokenWaits[j.Kind] = w
+}
+
+func (r *runner) skipJob(j job, failed int) {
+	res := result{job: j, err: fmt.Errorf("job %d: dependency %d failed: %w", j.ID, failed, errJobSkipped)}
+	r.finish(j, &res, r.clock.Now())
+	r.logger.Info("job skipped",
+		Str("run", r.runID),
+		Int("job", j.ID),
+		Str("kind", j.Kind),
+		Int("failed_dependency", failed),
+	)
+}
+
+func (r *runner) logScale(msg, reason string, workers int, in scaleInput) {
+	r.logger.Info(msg,
+		Str("run", r.runID),
+		Str("reason", reason),
+		Int("workers", workers),
+		Int("busy", in.busy),
+		Int("queued", in.queued),
+		Duration("oldest_wait", in.oldestWait),
+	)
+}
+
+func (r *runner) worker(ctx context.Context, id int, jobs <-chan job, retire <-chan struct{}, results chan<- result, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for jobID := range jobs {
-		jobStart := time.Now()
-		err := processJob(ctx, jobID)
-		cost := time.Since(jobStart)
+	for {
+		var j job
+		select {
+		case <-retire:
+			return
+		case next, ok := <-jobs:
+			if !ok {
+				return
+			}
+			j = next
+		}
 
-		fields := []Field{
-			Str("run", runID),
-			Int("worker", id),
-			Int("job", jobID),
-			Duration("cost", cost),
+		res := r.process(ctx, id, j)
+		res.worker = id
+		r.logResult(res)
+		results <- res
+	}
+}
+
+func (r *runner) logResult(res result) {
+	fields := []Field{
+		Str("run", r.runID),
+		Int("worker", res.worker),
+		Int("job", res.job.ID),
+		Str("kind", res.job.Kind),
+		Str("priority", priorityName(res.job.Priority)),
+		Int("attempts", res.attempts),
+		Duration("cost", res.cost),
+	}
+	if res.job.tokenWait > 0 {
+		fields = append(fields, Duration("token_wait", res.job.tokenWait))
+	}
+
+	switch {
+	case res.err == nil:
+		r.logger.Info("job done", fields...)
+	case isCanceled(res.err):
+		r.logger.Info("job canceled", fields...)
+	case res.deadLettered:
+		r.logger.Error("job dead-lettered", append(fields, Err(res.err))...)
+	default:
+		r.logger.Error("job failed", append(fields, Err(res.err))...)
+	}
+}
+
+func (r *runner) process(ctx context.Context, workerID int, j job) result {
+	jobID := j.ID
+	policy := r.cfg.Retry
+	if r.cfg.Simulate {
+		policy.Rand = rand.New(rand.NewPCG(r.cfg.Seed, uint64(jobID)))
+	}
+	jobStart := r.clock.Now()
+	res := result{job: j}
+
+	ctx, span := startSpan(ctx, "job",
+		Int("job", jobID),
+		Str("kind", j.Kind),
+		Str("priority", priorityName(j.Priority)),
+		Int("worker", workerID),
+	)
+	defer func() {
+		span.SetAttr(Int("attempts", res.attempts), Str("dead_lettered", strconv.FormatBool(res.deadLettered)))
+		span.End(res.err)
+	}()
+
+	impl, err := r.registry.Build(j)
+	if err != nil {
+		res.attempts = 1
+		res.err = err
+		r.finish(j, &res, jobStart)
+		return res
+	}
+
+	for {
+		res.attempts++
+		if err := r.store.Start(jobID, workerID); err != nil {
+			r.logger.Error("wal write failed", Str("run", r.runID), Int("job", jobID), Err(err))
 		}
 
-		switch {
-		case err == nil:
-			logger.Info("job done", fields...)
-		case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
-			logger.Info("job canceled", fields...)
-		default:
-			logger.Error("job failed", append(fields, Err(err))...)
+		attemptCtx, attempt := startSpan(ctx, "attempt", Int("attempt", res.attempts))
+		res.err = impl.Run(attemptCtx, res.attempts)
+		attempt.End(res.err)
+		if !policy.Retryable(res.err) || res.attempts == policy.MaxAttempts {
+			break
 		}
 
-		results <- result{id: jobID, err: err, cost: cost}
+		wait := policy.Backoff(res.attempts + 1)
+		span.SetAttr(Duration("backoff_"+strconv.Itoa(res.attempts), wait))
+		r.logger.Info("job retry",
+			Str("run", r.runID),
+			Int("worker", workerID),
+			Int("job", jobID),
+			Int("attempt", res.attempts),
+			Duration("backoff", wait),
+			Err(res.err),
+		)
+		if err := sleepCtx(ctx, wait); err != nil {
+			res.err = err
+			break
+		}
 	}
+	r.finish(j, &res, jobStart)
+	return res
 }
 
-func processJob(ctx context.Context, id int) error {
-	delay := time.Duration(80+(id%5)*40) * time.Millisecond
-	timer := time.NewTimer(delay)
-	defer timer.Stop()
+func (r *runner) finish(j job, res *result, jobStart time.Time) {
+	res.cost = r.clock.Now().Sub(jobStart)
+
+	// Canceled jobs are resumed rather than dead-lettered, and skipped ones
+	// never ran: their WAL finish record is all they get.
+	if res.err != nil && !isCanceled(res.err) && !errors.Is(res.err, errJobSkipped) {
+		letter := deadLetter{
+			Run:       r.runID,
+			Job:       j.ID,
+			Kind:      j.Kind,
+			Priority:  j.Priority,
+			Payload:   j.Payload,
+			DependsOn: j.DependsOn,
+			Attempts:  res.attempts,
+			Err:       res.err.Error(),
+		}
+		if err := r.dlq.Add(letter); err != nil {
+			r.logger.Error("dlq write failed", Str("run", r.runID), Int("job", j.ID), Err(err))
+		} else {
+			res.deadLettered = true
+		}
+	}
+	if err := r.store.Finish(j.ID, res.err); err != nil {
+		r.logger.Error("wal write failed", Str("run", r.runID), Int("job", j.ID), Err(err))
+	}
+}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-timer.C:
+func isCanceled(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+func processJob(ctx context.Context, id, attempt int) error {
+	delay := time.Duration(80+(id%5)*40) * time.Millisecond
+	spanFromContext(ctx).SetAttr(Duration("delay", delay))
+	if err := clockFrom(ctx).Sleep(ctx, delay); err != nil {
+		return err
 	}
 
-	if id%9 == 0 {
+	switch {
+	case id%13 == 0:
+		return fmt.Errorf("job %d: %w", id, errJobFatal)
+	case id%9 == 0:
 		return fmt.Errorf("job %d: %w", id, errJobFailed)
+	case id%7 == 0 && attempt == 1:
+		return fmt.Errorf("job %d attempt %d: %w", id, attempt, errJobFailed)
 	}
 	return nil
 }
@@ -195,6 +815,15 @@ func NewLogger(service string) *Logger {
 	}
 }
 
+// newClockLogger stamps lines with the given clock instead of wall time.
+func newClockLogger(service string, clock Clock) *Logger {
+	return &Logger{
+		service: service,
+		logger:  log.New(os.Stdout, "", 0),
+		clock:   clock,
+	}
+}
+
 func (l *Logger) Info(msg string, fields ...Field) {
 	l.emit("INFO", msg, fields...)
 }
@@ -209,6 +838,9 @@ func (l *Logger) emit(level, msg string, fields ...Field) {
 		"service=" + l.service,
 		"msg=" + msg,
 	}
+	if l.clock != nil {
+		parts = append([]string{l.clock.Now().Format("2006/01/02 15:04:05.000000")}, parts...)
+	}
 	for _, f := range fields {
 		parts = append(parts, f.String())
 	}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+type histogram struct {
+	samples []time.Duration
+	counts  []int
+}
+
+type runStats struct {
+	start    time.Time
+	latency  histogram
+	busy     map[int]time.Duration
+	handled  map[int]int
+	finishes []time.Duration
+	failures []time.Duration
+	costs    map[int]time.Duration
+	deps     map[int][]int
+}
+
+type Report struct {
+	Run          string            `json:"run"`
+	Status       string            `json:"status"`
+	Jobs         int               `json:"jobs"`
+	Handled      int               `json:"handled"`
+	Failed       int               `json:"failed"`
+	Canceled     int               `json:"canceled"`
+	Retried      int               `json:"retried"`
+	DeadLettered int               `json:"dead_lettered"`
+	Skipped      int               `json:"skipped"`
+	Reassigned   int               `json:"reassigned"`
+	ElapsedMS    float64           `json:"elapsed_ms"`
+	CriticalPath CriticalPath      `json:"critical_path"`
+	Latency      LatencyReport     `json:"latency"`
+	Workers      []WorkerReport    `json:"workers"`
+	Timeline     []TimelineReport  `json:"timeline"`
+	Waits        []WaitReport      `json:"waits"`
+	TokenWaits   []TokenWaitReport `json:"token_waits"`
+	Buckets      []HistogramBucket `json:"histogram"`
+}
+
+type CriticalPath struct {
+	Jobs   []int   `json:"jobs"`
+	CostMS float64 `json:"cost_ms"`
+}
+
+type LatencyReport struct {
+	Count int     `json:"count"`
+	P50MS float64 `json:"p50_ms"`
+	P90MS float64 `json:"p90_ms"`
+	P99MS float64 `json:"p99_ms"`
+	MaxMS float64 `json:"max_ms"`
+}
+
+type HistogramBucket struct {
+	LE    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+type WorkerReport struct {
+	Worker      int     `json:"worker"`
+	Jobs        int     `json:"jobs"`
+	BusyMS      float64 `json:"busy_ms"`
+	Utilization float64 `json:"utilization"`
+}
+
+type TimelineReport struct {
+	OffsetMS  float64 `json:"offset_ms"`
+	Completed int     `json:"completed"`
+	Failed    int     `json:"failed"`
+}
+
+type WaitReport struct {
+	Priority string  `json:"priority"`
+	Jobs     int     `json:"jobs"`
+	AvgMS    float64 `json:"avg_ms"`
+	MaxMS    float64 `json:"max_ms"`
+}
+
+type TokenWaitReport struct {
+	Kind    string  `json:"kind"`
+	Jobs    int     `json:"jobs"`
+	TotalMS float64 `json:"total_ms"`
+	MaxMS   float64 `json:"max_ms"`
+}
+
+func newHistogram() histogram {
+	return histogram{counts: make([]int, len(latencyBounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.samples = append(h.samples, d)
+	i := sort.Search(len(latencyBounds), func(i int) bool {
+		return d <= latencyBounds[i]
+	})
+	h.counts[i]++
+}
+
+func (h histogram) percentile(p float64) time.Duration {
+	if len(h.samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), h.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func (h histogram) buckets() []HistogramBucket {
+	out := make([]HistogramBucket, 0, len(h.counts))
+	for i, count := range h.counts {
+		le := "+Inf"
+		if i < len(latencyBounds) {
+			le = latencyBounds[i].String()
+		}
+		out = append(out, HistogramBucket{LE: le, Count: count})
+	}
+	return out
+}
+
+func newRunStats(start time.Time) *runStats {
+	return &runStats{
+		start:   start,
+		latency: newHistogram(),
+		busy:    make(map[int]time.Duration),
+		handled: make(map[int]int),
+		costs:   make(map[int]time.Duration),
+		deps:    make(map[int][]int),
+	}
+}
+
+func (s *runStats) addWorker(id int) {
+	if _, ok := s.busy[id]; !ok {
+		s.busy[id] = 0
+	}
+}
+
+func (s *runStats) record(res result, now time.Time) {
+	s.latency.observe(res.cost)
+	s.busy[res.worker] += res.cost
+	s.handled[res.worker]++
+	// Canceled jobs neither completed nor failed, so the timeline skips them.
+	offset := now.Sub(s.start)
+	switch {
+	case res.err == nil:
+		s.finishes = append(s.finishes, offset)
+	case !isCanceled(res.err):
+		s.failures = append(s.failures, offset)
+	}
+	if res.err == nil {
+		s.costs[res.job.ID] = res.cost
+		s.deps[res.job.ID] = res.job.DependsOn
+	}
+}
+
+func newReport(runID string, summary Summary) Report {
+	rep := Report{
+		Run:          runID,
+		Status:       summary.Status,
+		Jobs:         summary.Jobs,
+		Handled:      summary.Handled,
+		Failed:       summary.Failed,
+		Canceled:     summary.Canceled,
+		Retried:      summary.Retried,
+		DeadLettered: summary.DeadLettered,
+		Skipped:      summary.Skipped,
+		Reassigned:   summary.Reassigned,
+		ElapsedMS:    ms(summary.Elapsed),
+	}
+	for p := priorityHigh; p >= priorityLow; p-- {
+		if w, ok := summary.Waits[priorityName(p)]; ok {
+			rep.Waits = append(rep.Waits, WaitReport{
+				Priority: priorityName(p),
+				Jobs:     w.Jobs,
+				AvgMS:    ms(w.Avg()),
+				MaxMS:    ms(w.Max),
+			})
+		}
+	}
+	for kind, w := range summary.TokenWaits {
+		rep.TokenWaits = append(rep.TokenWaits, TokenWaitReport{
+			Kind:    kind,
+			Jobs:    w.Jobs,
+			TotalMS: ms(w.Total),
+			MaxMS:   ms(w.Max),
+		})
+	}
+	sort.Slice(rep.TokenWaits, func(i, j int) bool { return rep.TokenWaits[i].Kind < rep.TokenWaits[j].Kind })
+
+	stats := summary.Stats
+	if stats == nil {
+		return rep
+	}
+	rep.Latency = LatencyReport{
+		Count: len(stats.latency.samples),
+		P50MS: ms(stats.latency.percentile(50)),
+		P90MS: ms(stats.latency.percentile(90)),
+		P99MS: ms(stats.latency.percentile(99)),
+		MaxMS: ms(stats.latency.percentile(100)),
+	}
+	rep.Buckets = stats.latency.buckets()
+	path, cost := criticalPath(stats.costs, stats.deps)
+	rep.CriticalPath = CriticalPath{Jobs: path, CostMS: ms(cost)}
+
+	workers := make([]int, 0, len(stats.busy))
+	for id := range stats.busy {
+		workers = append(workers, id)
+	}
+	sort.Ints(workers)
+	for _, id := range workers {
+		wr := WorkerReport{Worker: id, Jobs: stats.handled[id], BusyMS: ms(stats.busy[id])}
+		if summary.Elapsed > 0 {
+			wr.Utilization = round(float64(stats.busy[id]) / float64(summary.Elapsed))
+		}
+		rep.Workers = append(rep.Workers, wr)
+	}
+
+	rep.Timeline = timeline(stats.finishes, stats.failures, summary.Elapsed)
+	return rep
+}
+
+func timeline(finishes, failures []time.Duration, elapsed time.Duration) []TimelineReport {
+	width := (elapsed / 20).Truncate(time.Millisecond)
+	if width < time.Millisecond {
+		width = time.Millisecond
+	}
+	n := int(elapsed/width) + 1
+	points := make([]TimelineReport, n)
+	for i := range points {
+		points[i].OffsetMS = ms(time.Duration(i) * width)
+	}
+	bucket := func(offset time.Duration) int {
+		i := int(offset / width)
+		if i >= n {
+			i = n - 1
+		}
+		return i
+	}
+	for _, offset := range finishes {
+		points[bucket(offset)].Completed++
+	}
+	for _, offset := range failures {
+		points[bucket(offset)].Failed++
+	}
+	return points
+}
+
+func writeReport(path string, rep Report) ([]string, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if dir := filepath.Dir(base); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create report dir: %w", err)
+		}
+	}
+
+	jsonPath, csvPath := base+".json", base+".csv"
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encode report: %w", err)
+	}
+	if err := os.WriteFile(jsonPath, append(data, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("write report: %w", err)
+	}
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		return nil, fmt.Errorf("write report: %w", err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	_ = w.WriteAll(rep.rows())
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("write report: %w", err)
+	}
+	return []string{jsonPath, csvPath}, f.Close()
+}
+
+func (r Report) rows() [][]string {
+	rows := [][]string{
+		{"section", "key", "value"},
+		{"run", "id", r.Run},
+		{"run", "status", r.Status},
+		{"run", "jobs", strconv.Itoa(r.Jobs)},
+		{"run", "handled", strconv.Itoa(r.Handled)},
+		{"run", "failed", strconv.Itoa(r.Failed)},
+		{"run", "canceled", strconv.Itoa(r.Canceled)},
+		{"run", "retried", strconv.Itoa(r.Retried)},
+		{"run", "dead_lettered", strconv.Itoa(r.DeadLettered)},
+		{"run", "skipped", strconv.Itoa(r.Skipped)},
+		{"run", "reassigned", strconv.Itoa(r.Reassigned)},
+		{"run", "elapsed_ms", formatFloat(r.ElapsedMS)},
+		{"critical_path", "jobs", joinIDs(r.CriticalPath.Jobs, " ")},
+		{"critical_path", "cost_ms", formatFloat(r.CriticalPath.CostMS)},
+		{"latency", "count", strconv.Itoa(r.Latency.Count)},
+		{"latency", "p50_ms", formatFloat(r.Latency.P50MS)},
+		{"latency", "p90_ms", formatFloat(r.Latency.P90MS)},
+		{"latency", "p99_ms", formatFloat(r.Latency.P99MS)},
+		{"latency", "max_ms", formatFloat(r.Latency.MaxMS)},
+	}
+	for _, b := range r.Buckets {
+		rows = append(rows, []string{"histogram", "le_" + b.LE, strconv.Itoa(b.Count)})
+	}
+	for _, w := range r.Workers {
+		id := strconv.Itoa(w.Worker)
+		rows = append(rows,
+			[]string{"worker", id + "_jobs", strconv.Itoa(w.Jobs)},
+			[]string{"worker", id + "_busy_ms", formatFloat(w.BusyMS)},
+			[]string{"worker", id + "_utilization", formatFloat(w.Utilization)},
+		)
+	}
+	for _, w := range r.Waits {
+		rows = append(rows,
+			[]string{"wait", w.Priority + "_avg_ms", formatFloat(w.AvgMS)},
+			[]string{"wait", w.Priority + "_max_ms", formatFloat(w.MaxMS)},
+		)
+	}
+	for _, w := range r.TokenWaits {
+		rows = append(rows,
+			[]string{"token_wait", w.Kind + "_jobs", strconv.Itoa(w.Jobs)},
+			[]string{"token_wait", w.Kind + "_total_ms", formatFloat(w.TotalMS)},
+			[]string{"token_wait", w.Kind + "_max_ms", formatFloat(w.MaxMS)},
+		)
+	}
+	for _, p := range r.Timeline {
+		offset := formatFloat(p.OffsetMS)
+		rows = append(rows,
+			[]string{"timeline", offset + "_completed", strconv.Itoa(p.Completed)},
+			[]string{"timeline", offset + "_failed", strconv.Itoa(p.Failed)},
+		)
+	}
+	return rows
+}
+
+func ms(d time.Duration) float64 {
+	return round(float64(d) / float64(time.Millisecond))
+}
+
+func round(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimelineSkipsCanceled(t *testing.T) {
+	start := time.Unix(0, 0)
+	stats := newRunStats(start)
+	stats.record(result{job: job{ID: 1}, worker: 1}, start.Add(time.Millisecond))
+	stats.record(result{job: job{ID: 2}, worker: 1, err: context.Canceled}, start.Add(2*time.Millisecond))
+	stats.record(result{job: job{ID: 3}, worker: 1, err: errors.New("boom")}, start.Add(3*time.Millisecond))
+
+	completed, failed := 0, 0
+	for _, p := range timeline(stats.finishes, stats.failures, 20*time.Millisecond) {
+		completed += p.Completed
+		failed += p.Failed
+	}
+	if completed != 1 || failed != 1 {
+		t.Fatalf("timeline completed=%d failed=%d, want 1 and 1", completed, failed)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+var errJobFatal = errors.New("job fatal")
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Fatal       []error
+	Rand        *rand.Rand
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   50 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Fatal:       []error{errJobFatal},
+	}
+}
+
+func (p RetryPolicy) Retryable(err error) bool {
+	if err == nil || isCanceled(err) {
+		return false
+	}
+	for _, fatal := range p.Fatal {
+		if errors.Is(err, fatal) {
+			return false
+		}
+	}
+	return true
+}
+
+// Backoff returns the wait before the given retry attempt (2 = first retry),
+// using "equal jitter": half of the exponential step is fixed, half is random.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 2; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	if p.Rand != nil {
+		return half + time.Duration(p.Rand.Int64N(int64(half)+1))
+	}
+	return half + time.Duration(rand.Int64N(int64(half)+1))
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	return clockFrom(ctx).Sleep(ctx, d)
+}
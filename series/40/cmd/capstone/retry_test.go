@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestBackoffEqualJitterBounds(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second, Rand: rand.New(rand.NewPCG(1, 2))}
+	cases := []struct {
+		attempt int
+		step    time.Duration
+	}{
+		{2, 50 * time.Millisecond},
+		{3, 100 * time.Millisecond},
+		{4, 200 * time.Millisecond},
+		{6, 800 * time.Millisecond},
+		{7, time.Second},
+		{30, time.Second},
+	}
+	for _, tc := range cases {
+		for i := 0; i < 200; i++ {
+			if d := p.Backoff(tc.attempt); d < tc.step/2 || d > tc.step {
+				t.Fatalf("Backoff(%d) = %v, want within [%v, %v]", tc.attempt, d, tc.step/2, tc.step)
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	p := defaultRetryPolicy()
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errJobFailed, true},
+		{fmt.Errorf("attempt 2: %w", errJobFailed), true},
+		{fmt.Errorf("bad payload: %w", errJobFatal), false},
+		{context.Canceled, false},
+		{fmt.Errorf("http: %w", context.DeadlineExceeded), false},
+		{errors.New("connection reset"), true},
+	}
+	for _, tc := range cases {
+		if got := p.Retryable(tc.err); got != tc.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
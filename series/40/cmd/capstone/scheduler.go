@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = []string{"low", "normal", "high"}
+
+const defaultKind = "sim"
+
+type job struct {
+	ID         int
+	Kind       string
+	Priority   int
+	Payload    json.RawMessage
+	DependsOn  []int
+	enqueuedAt time.Time
+	tokenWait  time.Duration
+}
+
+type WaitStats struct {
+	Jobs  int
+	Total time.Duration
+	Max   time.Duration
+}
+
+type queuedJob struct {
+	job
+	seq int
+}
+
+type jobHeap []queuedJob
+
+type kindQueue struct {
+	name   string
+	weight int
+	pass   float64
+	jobs   jobHeap
+}
+
+// scheduler hands out jobs with strict priority across classes and
+// stride-based weighted fair sharing across kinds within a class. When allow
+// is set, kinds it refuses are passed over so they cannot hold up the rest.
+type scheduler struct {
+	weights map[string]int
+	allow   func(kind string) bool
+	kinds   map[string]*kindQueue
+	order   []*kindQueue
+	vtime   float64
+	seq     int
+	size    int
+}
+
+func newScheduler(weights map[string]int) *scheduler {
+	return &scheduler{
+		weights: weights,
+		kinds:   make(map[string]*kindQueue),
+	}
+}
+
+func (s *scheduler) len() int {
+	return s.size
+}
+
+func (s *scheduler) push(j job) {
+	kq, ok := s.kinds[j.Kind]
+	if !ok {
+		weight := s.weights[j.Kind]
+		if weight <= 0 {
+			weight = 1
+		}
+		kq = &kindQueue{name: j.Kind, weight: weight}
+		s.kinds[j.Kind] = kq
+		s.order = append(s.order, kq)
+	}
+	// A kind that was idle must not bank credit and then starve the others.
+	if len(kq.jobs) == 0 && kq.pass < s.vtime {
+		kq.pass = s.vtime
+	}
+	s.seq++
+	heap.Push(&kq.jobs, queuedJob{job: j, seq: s.seq})
+	s.size++
+}
+
+func (s *scheduler) peek() (queuedJob, bool) {
+	kq := s.pick()
+	if kq == nil {
+		return queuedJob{}, false
+	}
+	return kq.jobs[0], true
+}
+
+func (s *scheduler) pop() (job, bool) {
+	kq := s.pick()
+	if kq == nil {
+		return job{}, false
+	}
+	return s.remove(kq), true
+}
+
+// take removes a job returned by peek. allow can change its answer between
+// the two calls, so pick may by then prefer another kind; taking by kind and
+// sequence keeps the dispatched job and the removed one the same.
+func (s *scheduler) take(qj queuedJob) bool {
+	kq := s.kinds[qj.Kind]
+	if kq == nil || len(kq.jobs) == 0 || kq.jobs[0].seq != qj.seq {
+		return false
+	}
+	s.remove(kq)
+	return true
+}
+
+func (s *scheduler) remove(kq *kindQueue) job {
+	qj := heap.Pop(&kq.jobs).(queuedJob)
+	s.size--
+	s.vtime = kq.pass
+	kq.pass += 1 / float64(kq.weight)
+	return qj.job
+}
+
+func (s *scheduler) oldest() (time.Time, bool) {
+	var oldest time.Time
+	for _, kq := range s.order {
+		for _, qj := range kq.jobs {
+			if oldest.IsZero() || qj.enqueuedAt.Before(oldest) {
+				oldest = qj.enqueuedAt
+			}
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+func (s *scheduler) pick() *kindQueue {
+	var best *kindQueue
+	for _, kq := range s.order {
+		if len(kq.jobs) == 0 || (s.allow != nil && !s.allow(kq.name)) {
+			continue
+		}
+		if best == nil {
+			best = kq
+			continue
+		}
+		head, bestHead := kq.jobs[0].Priority, best.jobs[0].Priority
+		if head > bestHead || (head == bestHead && kq.pass < best.pass) {
+			best = kq
+		}
+	}
+	return best
+}
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x any) { *h = append(*h, x.(queuedJob)) }
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+func generateJobs(n int) []job {
+	jobs := make([]job, 0, n)
+	for i := 1; i <= n; i++ {
+		jobs = append(jobs, job{ID: i, Kind: defaultKind, Priority: priorityFor(i)})
+	}
+	return jobs
+}
+
+func priorityFor(id int) int {
+	switch {
+	case id%5 == 0:
+		return priorityHigh
+	case id%3 == 0:
+		return priorityLow
+	default:
+		return priorityNormal
+	}
+}
+
+func priorityName(p int) string {
+	if p < 0 || p >= len(priorityNames) {
+		return strconv.Itoa(p)
+	}
+	return priorityNames[p]
+}
+
+type kindWeights map[string]int
+
+func (w kindWeights) String() string {
+	names := make([]string, 0, len(w))
+	for name := range w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+strconv.Itoa(w[name]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (w kindWeights) Set(raw string) error {
+	for k := range w {
+		delete(w, k)
+	}
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid kind weight %q", part)
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("invalid weight for kind %q", name)
+		}
+		w[name] = weight
+	}
+	return nil
+}
+
+func (w WaitStats) Avg() time.Duration {
+	if w.Jobs == 0 {
+		return 0
+	}
+	return w.Total / time.Duration(w.Jobs)
+}
+
+func (w *WaitStats) add(d time.Duration) {
+	w.Jobs++
+	w.Total += d
+	if d > w.Max {
+		w.Max = d
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestSchedulerPriorityFirst(t *testing.T) {
+	s := newScheduler(nil)
+	for i := 1; i <= 50; i++ {
+		s.push(job{ID: i, Kind: "bulk", Priority: priorityLow})
+	}
+	s.push(job{ID: 100, Kind: "urgent", Priority: priorityHigh})
+
+	got, ok := s.pop()
+	if !ok {
+		t.Fatal("expected a job")
+	}
+	if got.ID != 100 {
+		t.Fatalf("first job = %d, want 100", got.ID)
+	}
+}
+
+func TestSchedulerWeightedFairShare(t *testing.T) {
+	s := newScheduler(map[string]int{"import": 3, "export": 1})
+	for i := 1; i <= 40; i++ {
+		s.push(job{ID: i, Kind: "import", Priority: priorityNormal})
+		s.push(job{ID: 100 + i, Kind: "export", Priority: priorityNormal})
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		j, _ := s.pop()
+		counts[j.Kind]++
+	}
+	if counts["import"] != 15 || counts["export"] != 5 {
+		t.Fatalf("counts = %v, want import=15 export=5", counts)
+	}
+}
+
+func TestSchedulerFIFOWithinKind(t *testing.T) {
+	s := newScheduler(nil)
+	for i := 1; i <= 3; i++ {
+		s.push(job{ID: i, Kind: defaultKind, Priority: priorityNormal})
+	}
+
+	for want := 1; want <= 3; want++ {
+		got, _ := s.pop()
+		if got.ID != want {
+			t.Fatalf("pop = %d, want %d", got.ID, want)
+		}
+	}
+	if _, ok := s.pop(); ok {
+		t.Fatal("expected empty scheduler")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type progress struct {
+	mu      sync.Mutex
+	summary Summary
+}
+
+type managedRun struct {
+	id        string
+	cfg       Config
+	jobs      int
+	startedAt time.Time
+	cancel    context.CancelFunc
+	progress  *progress
+
+	mu         sync.Mutex
+	state      string
+	canceled   bool
+	finishedAt time.Time
+}
+
+const defaultKeepRuns = 100
+
+type runManager struct {
+	base     Config
+	logger   *Logger
+	registry *Registry
+	// keep bounds how many finished runs stay listed; running ones always do.
+	keep int
+
+	mu   sync.RWMutex
+	runs map[string]*managedRun
+}
+
+type submitRunRequest struct {
+	Jobs    int    `json:"jobs"`
+	Workers int    `json:"workers"`
+	Timeout string `json:"timeout"`
+}
+
+type progressView struct {
+	Handled      int    `json:"handled"`
+	Failed       int    `json:"failed"`
+	Canceled     int    `json:"canceled"`
+	Retried      int    `json:"retried"`
+	DeadLettered int    `json:"dead_lettered"`
+	Skipped      int    `json:"skipped"`
+	Elapsed      string `json:"elapsed"`
+}
+
+type runView struct {
+	ID         string       `json:"id"`
+	State      string       `json:"state"`
+	Jobs       int          `json:"jobs"`
+	Workers    int          `json:"workers"`
+	Timeout    string       `json:"timeout"`
+	StartedAt  string       `json:"started_at"`
+	FinishedAt string       `json:"finished_at,omitempty"`
+	Progress   progressView `json:"progress"`
+}
+
+func serveMain(args []string) {
+	cfg := defaultConfig()
+	addr := ":8080"
+	keep := defaultKeepRuns
+	fs := flag.NewFlagSet("capstone serve", flag.ExitOnError)
+	registerFlags(fs, &cfg)
+	registerAutoscaleFlags(fs, &cfg)
+	fs.StringVar(&addr, "addr", addr, "listen address")
+	fs.IntVar(&keep, "keep-runs", keep, "finished runs kept for GET /runs; older ones are forgotten")
+	_ = fs.Parse(args)
+	if keep <= 0 {
+		log.Fatal("keep-runs must be positive")
+	}
+
+	logger := NewLogger("capstone")
+	manager := newRunManager(cfg, logger, keep)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           buildServeHandler(manager, logger),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	logger.Info("serve start", Str("addr", addr))
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+func newRunManager(base Config, logger *Logger, keep int) *runManager {
+	base.Resume = ""
+	base.ReplayDLQ = false
+	base.JobsFile = ""
+	return &runManager{
+		base:     base,
+		logger:   logger,
+		registry: defaultRegistry(),
+		keep:     keep,
+		runs:     make(map[string]*managedRun),
+	}
+}
+
+func (m *runManager) submit(req submitRunRequest) (*managedRun, error) {
+	cfg := m.base
+	if req.Jobs != 0 {
+		cfg.Jobs = req.Jobs
+	}
+	if req.Workers != 0 {
+		cfg.Workers = req.Workers
+	}
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+		cfg.Timeout = timeout
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	runID, store, pending, err := openRun(cfg, m.registry)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	mr := &managedRun{
+		id:        runID,
+		cfg:       cfg,
+		jobs:      len(pending),
+		startedAt: time.Now(),
+		cancel:    cancel,
+		progress:  &progress{},
+		state:     stateRunning,
+	}
+
+	m.mu.Lock()
+	m.runs[runID] = mr
+	m.mu.Unlock()
+
+	m.logger.Info("run start",
+		Str("run", runID),
+		Int("jobs", len(pending)),
+		Int("workers", cfg.Workers),
+		Duration("timeout", cfg.Timeout),
+	)
+
+	go func() {
+		defer store.Close()
+		defer cancel()
+
+		r := &runner{
+			cfg:      cfg,
+			logger:   m.logger,
+			runID:    runID,
+			store:    store,
+			dlq:      newDeadLetterQueue(cfg.DLQPath),
+			registry: m.registry,
+			progress: mr.progress,
+			clock:    realClock{},
+		}
+		summary := r.run(ctx, pending)
+		summary.Status = mr.finish(ctx.Err())
+		mr.progress.set(summary)
+		m.prune()
+
+		m.logger.Info("run summary",
+			Str("run", runID),
+			Str("status", summary.Status),
+			Int("handled", summary.Handled),
+			Int("failed", summary.Failed),
+			Int("canceled", summary.Canceled),
+			Duration("cost", summary.Elapsed),
+		)
+	}()
+
+	return mr, nil
+}
+
+// prune forgets the runs that finished longest ago once more than keep have
+// finished, so a long-lived server does not grow without bound.
+func (m *runManager) prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type finished struct {
+		id string
+		at time.Time
+	}
+	var done []finished
+	for id, mr := range m.runs {
+		mr.mu.Lock()
+		at := mr.finishedAt
+		mr.mu.Unlock()
+		if !at.IsZero() {
+			done = append(done, finished{id, at})
+		}
+	}
+	if len(done) <= m.keep {
+		return
+	}
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].at.Before(done[j].at)
+	})
+	for _, f := range done[:len(done)-m.keep] {
+		delete(m.runs, f.id)
+	}
+}
+
+func (m *runManager) get(id string) (*managedRun, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	mr, ok := m.runs[id]
+	return mr, ok
+}
+
+func (m *runManager) list() []runView {
+	m.mu.RLock()
+	runs := make([]*managedRun, 0, len(m.runs))
+	for _, mr := range m.runs {
+		runs = append(runs, mr)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].startedAt.Before(runs[j].startedAt)
+	})
+	views := make([]runView, 0, len(runs))
+	for _, mr := range runs {
+		views = append(views, mr.view())
+	}
+	return views
+}
+
+func (mr *managedRun) requestCancel() bool {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if mr.state != stateRunning {
+		return false
+	}
+	mr.canceled = true
+	mr.cancel()
+	return true
+}
+
+func (mr *managedRun) finish(ctxErr error) string {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	switch {
+	case mr.canceled:
+		mr.state = stateCanceled
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		mr.state = stateTimeout
+	default:
+		mr.state = stateDone
+	}
+	mr.finishedAt = time.Now()
+	return mr.state
+}
+
+func (mr *managedRun) view() runView {
+	mr.mu.Lock()
+	state, finishedAt := mr.state, mr.finishedAt
+	mr.mu.Unlock()
+
+	summary := mr.progress.get()
+	if state == stateRunning {
+		summary.Elapsed = time.Since(mr.startedAt)
+	}
+
+	v := runView{
+		ID:        mr.id,
+		State:     state,
+		Jobs:      mr.jobs,
+		Workers:   mr.cfg.Workers,
+		Timeout:   mr.cfg.Timeout.String(),
+		StartedAt: mr.startedAt.Format(time.RFC3339Nano),
+		Progress: progressView{
+			Handled:      summary.Handled,
+			Failed:       summary.Failed,
+			Canceled:     summary.Canceled,
+			Retried:      summary.Retried,
+			DeadLettered: summary.DeadLettered,
+			Skipped:      summary.Skipped,
+			Elapsed:      summary.Elapsed.String(),
+		},
+	}
+	if !finishedAt.IsZero() {
+		v.FinishedAt = finishedAt.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+func (p *progress) set(s Summary) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.summary = s
+}
+
+func (p *progress) get() Summary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.summary
+}
+
+type serveAPI struct {
+	manager *runManager
+}
+
+func buildServeHandler(manager *runManager, logger *Logger) http.Handler {
+	api := &serveAPI{manager: manager}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/runs", api.handleRuns)
+	mux.HandleFunc("/runs/", api.handleRun)
+
+	return chain(mux, recoverMiddleware, logMiddleware(logger), jsonMiddleware)
+}
+
+func (a *serveAPI) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.manager.list())
+	case http.MethodPost:
+		var req submitRunRequest
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		mr, err := a.manager.submit(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, mr.view())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *serveAPI) handleRun(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/runs/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	mr, ok := a.manager.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "run not found")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, mr.view())
+	case action == "cancel" && r.Method == http.MethodPost:
+		if !mr.requestCancel() {
+			writeError(w, http.StatusConflict, "run is not running")
+			return
+		}
+		writeJSON(w, http.StatusAccepted, mr.view())
+	case action == "" || action == "cancel":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func chain(h http.Handler, m ...func(http.Handler) http.Handler) http.Handler {
+	wrapped := h
+	for i := len(m) - 1; i >= 0; i-- {
+		wrapped = m[i](wrapped)
+	}
+	return wrapped
+}
+
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				writeError(w, http.StatusInternalServerError, "internal error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func logMiddleware(logger *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			logger.Info("http request",
+				Str("method", r.Method),
+				Str("path", r.URL.Path),
+				Duration("cost", time.Since(start)),
+			)
+		})
+	}
+}
+
+func jsonMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func readJSON(r *http.Request, dst any) error {
+	defer r.Body.Close()
+
+	limited := io.LimitReader(r.Body, 1<<20)
+	dec := json.NewDecoder(limited)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("invalid json: %w", err)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return fmt.Errorf("invalid json: unexpected extra data")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
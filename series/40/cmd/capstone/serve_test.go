@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testServeHandler(t *testing.T, keep int) (http.Handler, *runManager) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.WALDir, cfg.DLQPath = dir, filepath.Join(dir, "dead-letter.jsonl")
+	logger := &Logger{service: "capstone", logger: log.New(io.Discard, "", 0)}
+	manager := newRunManager(cfg, logger, keep)
+	return buildServeHandler(manager, logger), manager
+}
+
+func serveDo(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeRun(t *testing.T, rec *httptest.ResponseRecorder) runView {
+	t.Helper()
+	var v runView
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+// waitRun polls a run until it leaves the running state.
+func waitRun(t *testing.T, h http.Handler, id string) runView {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if v := decodeRun(t, serveDo(t, h, http.MethodGet, "/runs/"+id, "")); v.State != stateRunning {
+			return v
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("run %s still running", id)
+	return runView{}
+}
+
+func TestServeSubmitAndGet(t *testing.T) {
+	h, _ := testServeHandler(t, defaultKeepRuns)
+
+	rec := serveDo(t, h, http.MethodPost, "/runs", `{"jobs":3,"workers":3,"timeout":"5s"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("submit: status = %d body=%s", rec.Code, rec.Body)
+	}
+	run := decodeRun(t, rec)
+	if run.State != stateRunning || run.Jobs != 3 || run.Workers != 3 || run.Timeout != "5s" {
+		t.Fatalf("submitted run = %+v", run)
+	}
+
+	done := waitRun(t, h, run.ID)
+	if done.State != stateDone || done.Progress.Handled != 3 || done.FinishedAt == "" {
+		t.Fatalf("finished run = %+v", done)
+	}
+	var runs []runView
+	if err := json.Unmarshal(serveDo(t, h, http.MethodGet, "/runs", "").Body.Bytes(), &runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].ID != run.ID {
+		t.Fatalf("list = %+v", runs)
+	}
+	if rec := serveDo(t, h, http.MethodPost, "/runs/"+run.ID+"/cancel", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("cancel finished run: status = %d, want 409", rec.Code)
+	}
+}
+
+func TestServeCancel(t *testing.T) {
+	h, _ := testServeHandler(t, defaultKeepRuns)
+	run := decodeRun(t, serveDo(t, h, http.MethodPost, "/runs", `{"jobs":50,"workers":1,"timeout":"1m"}`))
+
+	if rec := serveDo(t, h, http.MethodPost, "/runs/"+run.ID+"/cancel", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("cancel: status = %d body=%s", rec.Code, rec.Body)
+	}
+	if done := waitRun(t, h, run.ID); done.State != stateCanceled || done.Progress.Handled == 50 {
+		t.Fatalf("canceled run = %+v", done)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	h, _ := testServeHandler(t, defaultKeepRuns)
+	cases := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/runs", `{"jobs":`, http.StatusBadRequest},
+		{http.MethodPost, "/runs", `{"jobs":1,"color":"red"}`, http.StatusBadRequest},
+		{http.MethodPost, "/runs", `{"timeout":"soon"}`, http.StatusBadRequest},
+		{http.MethodPost, "/runs", `{"workers":-1}`, http.StatusBadRequest},
+		{http.MethodDelete, "/runs", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/runs/nope", "", http.StatusNotFound},
+		{http.MethodPost, "/runs/nope/cancel", "", http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if rec := serveDo(t, h, tc.method, tc.path, tc.body); rec.Code != tc.want {
+			t.Errorf("%s %s %s: status = %d, want %d", tc.method, tc.path, tc.body, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestServeForgetsOldRuns(t *testing.T) {
+	h, manager := testServeHandler(t, 1)
+
+	first := decodeRun(t, serveDo(t, h, http.MethodPost, "/runs", `{"jobs":1}`))
+	waitRun(t, h, first.ID)
+	second := decodeRun(t, serveDo(t, h, http.MethodPost, "/runs", `{"jobs":1}`))
+	waitRun(t, h, second.ID)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.list()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	runs := manager.list()
+	if len(runs) != 1 || runs[0].ID != second.ID {
+		t.Fatalf("runs = %+v, want only %s", runs, second.ID)
+	}
+	if rec := serveDo(t, h, http.MethodGet, "/runs/"+first.ID, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("forgotten run: status = %d, want 404", rec.Code)
+	}
+}
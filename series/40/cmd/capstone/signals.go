@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type signalWatch struct {
+	stop <-chan struct{}
+	hit  *atomic.Bool
+}
+
+// watchSignals turns the first SIGINT/SIGTERM into a drain: dispatch stops at
+// once and in-flight jobs get until the drain deadline before cancel is called.
+// A second signal exits immediately; the WAL is already synced per record.
+func watchSignals(logger *Logger, runID string, drain time.Duration, cancel context.CancelFunc, finished <-chan struct{}) signalWatch {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+	hit := &atomic.Bool{}
+	go func() {
+		defer signal.Stop(sigs)
+
+		var sig os.Signal
+		select {
+		case sig = <-sigs:
+		case <-finished:
+			return
+		}
+
+		hit.Store(true)
+		close(stop)
+		logger.Info("run draining", Str("run", runID), Str("signal", sig.String()), Duration("drain", drain))
+		timer := time.AfterFunc(drain, func() {
+			logger.Info("drain deadline exceeded", Str("run", runID))
+			cancel()
+		})
+		defer timer.Stop()
+
+		select {
+		case sig = <-sigs:
+			cancel()
+			logger.Error("run aborted", Str("run", runID), Str("signal", sig.String()))
+			os.Exit(130)
+		case <-finished:
+		}
+	}()
+
+	return signalWatch{stop: stop, hit: hit}
+}
+
+func (w signalWatch) interrupted() bool {
+	return w.hit.Load()
+}
+
+func runStatus(ctx context.Context, interrupted bool) string {
+	switch {
+	case interrupted:
+		return stateInterrupted
+	case errors.Is(context.Cause(ctx), context.DeadlineExceeded):
+		return stateTimeout
+	default:
+		return stateDone
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// drainRun runs five jobs on two workers, sends SIGINT once both workers are
+// busy and returns the summary, the run status and the WAL's final statuses.
+// Each job waits for its context, or for hold once the drain has started.
+func drainRun(t *testing.T, drain, hold time.Duration) (Summary, string, map[int]string) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.Jobs, cfg.Workers, cfg.Timeout, cfg.Drain = 5, 2, time.Minute, drain
+	cfg.WALDir, cfg.DLQPath = dir, filepath.Join(dir, "dead-letter.jsonl")
+
+	started := make(chan int, cfg.Jobs)
+	var stop <-chan struct{}
+	registry := defaultRegistry()
+	registry.Register(defaultKind, func(id int, _ json.RawMessage) (Job, error) {
+		return JobFunc(func(ctx context.Context, attempt int) error {
+			started <- id
+			select {
+			case <-stop:
+				select {
+				case <-time.After(hold):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}), nil
+	})
+
+	runID, store, pending, err := openRun(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	logger := &Logger{service: "capstone", logger: log.New(io.Discard, "", 0)}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	finished := make(chan struct{})
+	sig := watchSignals(logger, runID, cfg.Drain, cancel, finished)
+	stop = sig.stop
+
+	r := &runner{
+		cfg:      cfg,
+		logger:   logger,
+		runID:    runID,
+		store:    store,
+		dlq:      newDeadLetterQueue(cfg.DLQPath),
+		registry: registry,
+		stop:     sig.stop,
+		clock:    realClock{},
+	}
+	done := make(chan Summary)
+	go func() { done <- r.run(ctx, pending) }()
+
+	<-started
+	<-started
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	select {
+	case summary = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not stop after SIGINT")
+	}
+	close(finished)
+	status := runStatus(ctx, sig.interrupted())
+
+	state, _, err := replayWAL(walPath(dir, runID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summary, status, state.finished
+}
+
+func TestDrainDeadlineCancelsInFlight(t *testing.T) {
+	summary, status, finished := drainRun(t, 50*time.Millisecond, time.Minute)
+	if status != stateInterrupted {
+		t.Fatalf("status = %q, want %q", status, stateInterrupted)
+	}
+	if len(finished) != 2 || summary.Canceled != 2 {
+		t.Fatalf("finished = %v canceled = %d, want the two in-flight jobs", finished, summary.Canceled)
+	}
+	for id, st := range finished {
+		if st != statusCanceled {
+			t.Errorf("job %d finished as %q, want %q", id, st, statusCanceled)
+		}
+	}
+}
+
+func TestDrainLetsInFlightFinish(t *testing.T) {
+	summary, status, finished := drainRun(t, 5*time.Second, 10*time.Millisecond)
+	if status != stateInterrupted {
+		t.Fatalf("status = %q, want %q", status, stateInterrupted)
+	}
+	if len(finished) != 2 || summary.Canceled != 0 {
+		t.Fatalf("finished = %v canceled = %d, want two jobs done", finished, summary.Canceled)
+	}
+	for id, st := range finished {
+		if st != statusDone {
+			t.Errorf("job %d finished as %q, want %q", id, st, statusDone)
+		}
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+
+	cases := []struct {
+		ctx         context.Context
+		interrupted bool
+		want        string
+	}{
+		{context.Background(), false, stateDone},
+		{canceled, false, stateDone},
+		{expired, false, stateTimeout},
+		{expired, true, stateInterrupted},
+	}
+	for _, tc := range cases {
+		if got := runStatus(tc.ctx, tc.interrupted); got != tc.want {
+			t.Errorf("runStatus(%v, %v) = %q, want %q", tc.ctx.Err(), tc.interrupted, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// simEpoch is where every simulation starts, so virtual timestamps repeat
+// from run to run.
+var simEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simClock is a virtual clock for -simulate. Time only moves when the run
+// loop calls advance, which it does once every in-flight job is asleep on
+// the clock; a sleep of ten minutes then costs nothing.
+type simClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	seq      int
+	timers   simTimers
+	sleeping int
+	wake     chan struct{}
+}
+
+type simTimer struct {
+	when    time.Time
+	seq     int
+	period  time.Duration
+	ch      chan time.Time
+	fn      func()
+	sleeper bool
+	fired   bool
+	index   int
+}
+
+type simTimers []*simTimer
+
+type simTicker struct {
+	clock *simClock
+	t     *simTimer
+}
+
+func newSimClock(start time.Time) *simClock {
+	return &simClock{now: start, wake: make(chan struct{}, 1)}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *simClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.schedule(&simTimer{when: c.now.Add(d), period: d, ch: make(chan time.Time, 1)})
+	return simTicker{clock: c, t: t}
+}
+
+func (c *simClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	t := c.schedule(&simTimer{when: c.now.Add(d), ch: make(chan time.Time, 1), sleeper: true})
+	c.sleeping++
+	c.mu.Unlock()
+	c.notify()
+
+	select {
+	case <-t.ch:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		if !t.fired {
+			c.cancel(t)
+			c.sleeping--
+		}
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// WithTimeout cancels with context.DeadlineExceeded as the cause once the
+// virtual deadline passes; runStatus reads the cause to report a timeout.
+func (c *simClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	c.mu.Lock()
+	t := c.schedule(&simTimer{when: c.now.Add(d), fn: func() { cancel(context.DeadlineExceeded) }})
+	c.mu.Unlock()
+	return ctx, func() {
+		c.mu.Lock()
+		c.cancel(t)
+		c.mu.Unlock()
+		cancel(context.Canceled)
+	}
+}
+
+// sleepers reports how many goroutines are blocked in Sleep.
+func (c *simClock) sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sleeping
+}
+
+// advance jumps to the earliest pending timer and fires every timer due at
+// that instant, in the order they were set. It reports false when nothing is
+// pending.
+func (c *simClock) advance() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	c.now = c.timers[0].when
+
+	var fns []func()
+	for len(c.timers) > 0 && !c.timers[0].when.After(c.now) {
+		t := heap.Pop(&c.timers).(*simTimer)
+		t.fired = true
+		if t.fn != nil {
+			fns = append(fns, t.fn)
+			continue
+		}
+		if t.sleeper {
+			c.sleeping--
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			t.fired = false
+			c.schedule(t)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+	return true
+}
+
+func (c *simClock) schedule(t *simTimer) *simTimer {
+	c.seq++
+	t.seq = c.seq
+	heap.Push(&c.timers, t)
+	return t
+}
+
+func (c *simClock) cancel(t *simTimer) {
+	if t.index >= 0 && t.index < len(c.timers) && c.timers[t.index] == t {
+		heap.Remove(&c.timers, t.index)
+	}
+}
+
+func (c *simClock) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t simTicker) C() <-chan time.Time {
+	return t.t.ch
+}
+
+func (t simTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.clock.cancel(t.t)
+}
+
+func (h simTimers) Len() int { return len(h) }
+
+func (h simTimers) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h simTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *simTimers) Push(x any) {
+	t := x.(*simTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *simTimers) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func simulate(t *testing.T, jobs int, timeout time.Duration, opts ...func(*Config)) (Summary, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.Jobs, cfg.Workers, cfg.Timeout = jobs, 4, timeout
+	cfg.WALDir, cfg.DLQPath = dir, filepath.Join(dir, "dead-letter.jsonl")
+	cfg.Simulate, cfg.Seed = true, 42
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	runID, store, pending, err := openRun(cfg, defaultRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	clock := newSimClock(simEpoch)
+	ctx, cancel := clock.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	r := &runner{
+		cfg:      cfg,
+		logger:   &Logger{service: "capstone", logger: log.New(io.Discard, "", 0), clock: clock},
+		runID:    runID,
+		store:    store,
+		dlq:      newDeadLetterQueue(cfg.DLQPath),
+		registry: defaultRegistry(),
+		clock:    clock,
+	}
+	summary := r.run(ctx, pending)
+	summary.Status = runStatus(ctx, false)
+
+	rep := newReport(runID, summary)
+	rep.Workers = nil
+	data, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summary, data
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	start := time.Now()
+	summary, first := simulate(t, 2000, 10*time.Minute)
+	if wall := time.Since(start); wall > 10*time.Second {
+		t.Fatalf("simulation took %v of wall time", wall)
+	}
+	if summary.Status != stateDone || summary.Elapsed < time.Minute {
+		t.Fatalf("status=%s elapsed=%v, want a long finished run", summary.Status, summary.Elapsed)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, again := simulate(t, 2000, 10*time.Minute); !bytes.Equal(first, again) {
+			t.Fatalf("run %d report differs:\n%s\n%s", i+2, first, again)
+		}
+	}
+}
+
+func TestSimulationTimeout(t *testing.T) {
+	summary, _ := simulate(t, 2000, time.Minute)
+	if summary.Status != stateTimeout {
+		t.Fatalf("status = %s, want %s", summary.Status, stateTimeout)
+	}
+	if summary.Elapsed != time.Minute {
+		t.Fatalf("elapsed = %v, want exactly the 1m virtual timeout", summary.Elapsed)
+	}
+}
+
+func TestSimulationRateLimit(t *testing.T) {
+	summary, _ := simulate(t, 21, time.Hour, func(cfg *Config) {
+		cfg.KindRates[defaultKind] = RateLimit{PerSecond: 2, Burst: 1}
+		cfg.KindCaps[defaultKind] = 1
+	})
+	if summary.Status != stateDone || summary.Handled != 21 {
+		t.Fatalf("status=%s handled=%d, want all 21 done", summary.Status, summary.Handled)
+	}
+	if summary.Elapsed < 10*time.Second {
+		t.Fatalf("elapsed = %v, want at least 10s at 2 jobs/s", summary.Elapsed)
+	}
+	w := summary.TokenWaits[defaultKind]
+	if w.Jobs == 0 || w.Max > 500*time.Millisecond {
+		t.Fatalf("token waits = %+v, want waits of at most one refill interval", w)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	spanStatusUnset = iota
+	spanStatusOK
+	spanStatusError
+)
+
+// spanKindInternal is OTLP's SPAN_KIND_INTERNAL.
+const spanKindInternal = 1
+
+type Tracer struct {
+	service string
+	traceID string
+	clock   Clock
+	mu      sync.Mutex
+	spans   []*Span
+}
+
+type Span struct {
+	tracer   *Tracer
+	id       string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []Field
+	status   int
+	message  string
+	mu       sync.Mutex
+}
+
+type spanKey struct{}
+
+func NewTracer(service string) *Tracer {
+	return &Tracer{service: service, traceID: randomHex(16), clock: realClock{}}
+}
+
+func (t *Tracer) TraceID() string {
+	return t.traceID
+}
+
+// Start opens a span under the one carried by ctx, if any, and returns a
+// context carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Field) (context.Context, *Span) {
+	s := &Span{
+		tracer: t,
+		id:     randomHex(8),
+		name:   name,
+		start:  t.clock.Now(),
+		attrs:  attrs,
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.parentID = parent.id
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan opens a child of the span in ctx. Without one there is nothing to
+// attach to, and the returned nil span ignores every call.
+func startSpan(ctx context.Context, name string, attrs ...Field) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, attrs...)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+func (s *Span) SetAttr(attrs ...Field) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *Span) ID() string {
+	if s == nil {
+		return ""
+	}
+	return s.id
+}
+
+// End closes the span with an error status when err is non-nil. Calls after
+// the first are ignored.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = s.tracer.clock.Now()
+	s.status = spanStatusOK
+	if err != nil {
+		s.status, s.message = spanStatusError, err.Error()
+	}
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Export returns the finished spans in the OTLP/JSON trace layout, with hex
+// IDs as the OTLP JSON mapping requires.
+func (t *Tracer) Export() otlpExport {
+	t.mu.Lock()
+	spans := append([]*Span(nil), t.spans...)
+	t.mu.Unlock()
+
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]Field{Str("service.name", t.service)})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: t.service},
+			Spans: out,
+		}},
+	}}}
+}
+
+func (t *Tracer) WriteFile(path string) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("create trace dir: %w", err)
+		}
+	}
+	data, err := json.MarshalIndent(t.Export(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode trace: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write trace: %w", err)
+	}
+	return nil
+}
+
+func otlpAttributes(fields []Field) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, otlpAttribute{Key: f.Key, Value: otlpValue{StringValue: f.Value}})
+	}
+	return attrs
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTracerLinksChildSpans(t *testing.T) {
+	tracer := NewTracer("capstone")
+	ctx, root := tracer.Start(context.Background(), "run")
+	jobCtx, job := startSpan(ctx, "job", Int("job", 1))
+	_, attempt := startSpan(jobCtx, "attempt", Int("attempt", 1))
+	attempt.End(errors.New("boom"))
+	job.End(nil)
+	root.End(nil)
+
+	spans := tracer.Export().ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(spans))
+	}
+	byName := make(map[string]otlpSpan)
+	for _, s := range spans {
+		if s.TraceID != tracer.TraceID() {
+			t.Fatalf("span %s trace = %s, want %s", s.Name, s.TraceID, tracer.TraceID())
+		}
+		byName[s.Name] = s
+	}
+	if byName["run"].ParentSpanID != "" {
+		t.Fatalf("root span has parent %s", byName["run"].ParentSpanID)
+	}
+	if byName["job"].ParentSpanID != byName["run"].SpanID {
+		t.Fatal("job span is not a child of the run span")
+	}
+	if byName["attempt"].ParentSpanID != byName["job"].SpanID {
+		t.Fatal("attempt span is not a child of the job span")
+	}
+	if got := byName["attempt"].Status; got.Code != spanStatusError || got.Message != "boom" {
+		t.Fatalf("attempt status = %+v, want error boom", got)
+	}
+}
+
+func TestStartSpanWithoutParentIsNoop(t *testing.T) {
+	ctx, span := startSpan(context.Background(), "job")
+	if span != nil || spanFromContext(ctx) != nil {
+		t.Fatal("expected no span without a parent")
+	}
+	span.SetAttr(Str("k", "v"))
+	span.End(nil)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	walRun     = "run"
+	walEnqueue = "enqueue"
+	walStart   = "start"
+	walFinish  = "finish"
+)
+
+const (
+	statusDone     = "done"
+	statusFailed   = "failed"
+	statusCanceled = "canceled"
+	statusSkipped  = "skipped"
+)
+
+type walRecord struct {
+	Op        string          `json:"op"`
+	Job       int             `json:"job,omitempty"`
+	Kind      string          `json:"kind,omitempty"`
+	Priority  int             `json:"priority,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	DependsOn []int           `json:"depends_on,omitempty"`
+	Jobs      int             `json:"jobs,omitempty"`
+	Worker    int             `json:"worker,omitempty"`
+	Status    string          `json:"status,omitempty"`
+	Err       string          `json:"err,omitempty"`
+	At        time.Time       `json:"at"`
+}
+
+type walState struct {
+	Jobs     int
+	enqueued []job
+	finished map[int]string
+}
+
+type jobStore struct {
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	noSync bool
+}
+
+func walPath(dir, runID string) string {
+	return filepath.Join(dir, runID+".wal")
+}
+
+func createJobStore(dir, runID string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create wal dir: %w", err)
+	}
+	f, err := os.OpenFile(walPath(dir, runID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create wal: %w", err)
+	}
+	return &jobStore{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// openJobStore replays a run's log and reopens it for appending. A torn
+// last record is cut off first, so new records start on a fresh line.
+func openJobStore(dir, runID string) (*jobStore, walState, error) {
+	path := walPath(dir, runID)
+	state, good, err := replayWAL(path)
+	if err != nil {
+		return nil, walState{}, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, walState{}, fmt.Errorf("open wal: %w", err)
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, walState{}, fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, walState{}, fmt.Errorf("seek wal: %w", err)
+	}
+	return &jobStore{file: f, enc: json.NewEncoder(f)}, state, nil
+}
+
+// replayWAL rebuilds the run's state and returns the offset just past its
+// last intact record.
+func replayWAL(path string) (walState, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return walState{}, 0, fmt.Errorf("read wal: %w", err)
+	}
+	defer f.Close()
+
+	state := walState{finished: make(map[int]string)}
+	seen := make(map[int]bool)
+	r := bufio.NewReader(f)
+	var good int64
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// An unterminated last line never finished its write.
+			break
+		}
+		if err != nil {
+			return walState{}, 0, fmt.Errorf("read wal: %w", err)
+		}
+		var rec walRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			// A torn final record means we crashed mid-append; everything before it is intact.
+			if _, peekErr := r.Peek(1); errors.Is(peekErr, io.EOF) {
+				break
+			}
+			return walState{}, 0, fmt.Errorf("wal line %d: %w", line, err)
+		}
+		good += int64(len(data))
+		switch rec.Op {
+		case walRun:
+			state.Jobs = rec.Jobs
+		case walEnqueue:
+			if !seen[rec.Job] {
+				seen[rec.Job] = true
+				j := job{ID: rec.Job, Kind: rec.Kind, Priority: rec.Priority, Payload: rec.Payload, DependsOn: rec.DependsOn}
+				if j.Kind == "" {
+					j.Kind = defaultKind
+				}
+				state.enqueued = append(state.enqueued, j)
+			}
+		case walFinish:
+			state.finished[rec.Job] = rec.Status
+		}
+	}
+	if state.Jobs == 0 {
+		return walState{}, 0, errors.New("wal has no run header")
+	}
+	return state, good, nil
+}
+
+// unfinished returns the jobs a resume has to dispatch again. Jobs anywhere
+// downstream of a failed or skipped job are left out: they can never run.
+func (s walState) unfinished() []job {
+	deps := make(map[int][]int, len(s.enqueued))
+	for _, j := range s.enqueued {
+		deps[j.ID] = j.DependsOn
+	}
+	blocked := make(map[int]bool)
+	var isBlocked func(id int) bool
+	isBlocked = func(id int) bool {
+		if b, ok := blocked[id]; ok {
+			return b
+		}
+		// Marked first so a malformed cycle cannot recurse forever.
+		blocked[id] = false
+		b := s.finished[id] == statusFailed || s.finished[id] == statusSkipped
+		for _, dep := range deps[id] {
+			b = b || isBlocked(dep)
+		}
+		blocked[id] = b
+		return b
+	}
+
+	var pending []job
+	for _, j := range s.enqueued {
+		status, ok := s.finished[j.ID]
+		if ok && status != statusCanceled {
+			continue
+		}
+		if !isBlocked(j.ID) {
+			pending = append(pending, j)
+		}
+	}
+	sort.Slice(pending, func(i, k int) bool {
+		return pending[i].ID < pending[k].ID
+	})
+	return pending
+}
+
+func (s *jobStore) Begin(jobs []job) error {
+	if err := s.append(walRecord{Op: walRun, Jobs: len(jobs)}); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		rec := walRecord{
+			Op:        walEnqueue,
+			Job:       j.ID,
+			Kind:      j.Kind,
+			Priority:  j.Priority,
+			Payload:   j.Payload,
+			DependsOn: j.DependsOn,
+		}
+		if err := s.append(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jobStore) Start(job, worker int) error {
+	return s.append(walRecord{Op: walStart, Job: job, Worker: worker})
+}
+
+func (s *jobStore) Finish(job int, err error) error {
+	rec := walRecord{Op: walFinish, Job: job, Status: statusOf(err)}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	return s.append(rec)
+}
+
+func (s *jobStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func (s *jobStore) append(rec walRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec.At = time.Now()
+	if err := s.enc.Encode(rec); err != nil {
+		return fmt.Errorf("append wal: %w", err)
+	}
+	if s.noSync {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	return nil
+}
+
+func statusOf(err error) string {
+	switch {
+	case err == nil:
+		return statusDone
+	case isCanceled(err):
+		return statusCanceled
+	case errors.Is(err, errJobSkipped):
+		return statusSkipped
+	default:
+		return statusFailed
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWALTornTailResume(t *testing.T) {
+	dir := t.TempDir()
+	store, err := createJobStore(dir, "run-torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.noSync = true
+	jobs := []job{{ID: 1, Kind: "noop"}, {ID: 2, Kind: "noop"}, {ID: 3, Kind: "noop"}}
+	if err := store.Begin(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Finish(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	f, err := os.OpenFile(walPath(dir, "run-torn"), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"finish","job":2,"sta`)
+	f.Close()
+
+	// Each resume appends; the second must still read the first's records.
+	for i, finish := range []int{2, 3} {
+		store, state, err := openJobStore(dir, "run-torn")
+		if err != nil {
+			t.Fatalf("resume %d: %v", i+1, err)
+		}
+		if len(state.finished) != finish-1 {
+			t.Fatalf("resume %d: finished = %v", i+1, state.finished)
+		}
+		if err := store.Finish(finish, nil); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+	}
+	state, _, err := replayWAL(walPath(dir, "run-torn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.unfinished()) != 0 {
+		t.Fatalf("unfinished = %v, want none", state.unfinished())
+	}
+}
+
+func TestUnfinishedBlocksTransitively(t *testing.T) {
+	state := walState{
+		enqueued: []job{
+			{ID: 1},
+			{ID: 2, DependsOn: []int{1}},
+			{ID: 3, DependsOn: []int{2}},
+			{ID: 4},
+		},
+		finished: map[int]string{1: statusFailed},
+	}
+	got := state.unfinished()
+	if len(got) != 1 || got[0].ID != 4 {
+		t.Fatalf("unfinished = %v, want only job 4", got)
+	}
+}